@@ -0,0 +1,524 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureMagic is written at the start of every
+// capture file.
+const captureMagic = "SPDYCAP1"
+
+// ErrInvalidCapture indicates that a capture file
+// could not be parsed.
+var ErrInvalidCapture = errors.New("Error: Invalid SPDY capture file.")
+
+// CaptureRecord is a single frame stored in a capture
+// file. Inbound indicates whether the frame was received
+// by the endpoint that made the capture, rather than
+// sent by it. Any name/value header blocks in Frame are
+// already decompressed.
+type CaptureRecord struct {
+	Time    time.Time
+	Inbound bool
+	Frame   Frame
+}
+
+// CaptureWriter is used to record a SPDY session to
+// a file. Frames are stored with their time and
+// direction, and with their headers decompressed, so
+// that a capture can be read without the compression
+// state of the original connection.
+//
+// The file format is the string "SPDYCAP1", followed
+// by the SPDY version (2 bytes) and subversion (1 byte).
+// Each record then consists of the direction (1 byte,
+// 1 for inbound), the time in nanoseconds since the
+// Unix epoch (8 bytes), the length of the frame (4
+// bytes), and the frame as it would be sent over the
+// network, except that any name/value header blocks
+// are not compressed.
+type CaptureWriter struct {
+	sync.Mutex
+	w          io.Writer
+	version    uint16
+	subversion int
+	compressor Compressor
+}
+
+// NewCaptureWriter is used to create a CaptureWriter, which
+// writes frames of the given SPDY version to w.
+func NewCaptureWriter(w io.Writer, version float64) (*CaptureWriter, error) {
+	if w == nil {
+		return nil, errors.New("Error: Capture initialised with nil io.Writer.")
+	}
+
+	out := new(CaptureWriter)
+	out.w = w
+	switch version {
+	case 2:
+		out.version = 2
+	case 3:
+		out.version = 3
+	case 3.1:
+		out.version = 3
+		out.subversion = 1
+	default:
+		return nil, ErrInvalidVersion
+	}
+	out.compressor = &plainCompressor{out.version}
+
+	header := make([]byte, len(captureMagic)+3)
+	copy(header, captureMagic)
+	header[8] = byte(out.version >> 8)
+	header[9] = byte(out.version)
+	header[10] = byte(out.subversion)
+	if err := write(w, header); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// WriteFrame adds the given frame to the capture. If the
+// frame has a name/value header block, its Header must be
+// set. The frame itself is not modified.
+func (c *CaptureWriter) WriteFrame(inbound bool, frame Frame) error {
+	if frame == nil {
+		return errors.New("Error: Nil frame captured.")
+	}
+
+	frame = captureFrame(frame)
+	if err := frame.Compress(c.compressor); err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := frame.WriteTo(buf); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	length := buf.Len()
+	out := make([]byte, 13)
+	if inbound {
+		out[0] = 1
+	}
+	for i := uint(0); i < 8; i++ {
+		out[1+i] = byte(now >> (56 - 8*i))
+	}
+	out[9] = byte(length >> 24)
+	out[10] = byte(length >> 16)
+	out[11] = byte(length >> 8)
+	out[12] = byte(length)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err := write(c.w, out); err != nil {
+		return err
+	}
+	return write(c.w, buf.Bytes())
+}
+
+// CaptureReader is used to read a capture file
+// created by a CaptureWriter.
+type CaptureReader struct {
+	r            *bufio.Reader
+	version      uint16
+	subversion   int
+	decompressor Decompressor
+}
+
+// NewCaptureReader is used to create a CaptureReader,
+// reading the capture from r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	if r == nil {
+		return nil, errors.New("Error: Capture initialised with nil io.Reader.")
+	}
+
+	out := new(CaptureReader)
+	out.r = bufio.NewReader(r)
+
+	header, err := read(out.r, len(captureMagic)+3)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != captureMagic {
+		return nil, ErrInvalidCapture
+	}
+	out.version = bytesToUint16(header[8:10])
+	out.subversion = int(header[10])
+	if out.version != 2 && out.version != 3 {
+		return nil, ErrInvalidVersion
+	}
+	out.decompressor = &plainDecompressor{out.version}
+
+	return out, nil
+}
+
+// Version returns the SPDY version of the captured
+// session, such as 3.1.
+func (c *CaptureReader) Version() float64 {
+	if c.version == 3 && c.subversion == 1 {
+		return 3.1
+	}
+	return float64(c.version)
+}
+
+// ReadRecord returns the next record in the capture. Once
+// all records have been read, io.EOF is returned.
+func (c *CaptureReader) ReadRecord() (*CaptureRecord, error) {
+	data, err := read(c.r, 13)
+	if err != nil {
+		return nil, err
+	}
+
+	var nanos int64
+	for _, b := range data[1:9] {
+		nanos = (nanos << 8) + int64(b)
+	}
+	length := int(bytesToUint32(data[9:13]))
+	if length > MAX_FRAME_SIZE+8 {
+		return nil, ErrInvalidCapture
+	}
+
+	raw, err := read(c.r, length)
+	if err != nil {
+		return nil, ErrInvalidCapture
+	}
+
+	var frame Frame
+	switch c.version {
+	case 3:
+		frame, err = readFrameV3(bufio.NewReader(bytes.NewReader(raw)), c.subversion)
+	case 2:
+		frame, err = readFrameV2(bufio.NewReader(bytes.NewReader(raw)))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = frame.Decompress(c.decompressor); err != nil {
+		return nil, err
+	}
+
+	out := new(CaptureRecord)
+	out.Time = time.Unix(0, nanos)
+	out.Inbound = data[0] == 1
+	out.Frame = frame
+	return out, nil
+}
+
+// SetCapture is used to record the connection's frames
+// to w, in the format described by CaptureWriter. A nil
+// io.Writer stops any capture in progress.
+func (conn *connV3) SetCapture(w io.Writer) error {
+	if w == nil {
+		conn.capture.Store((*CaptureWriter)(nil))
+		return nil
+	}
+
+	version := 3.0
+	if conn.subversion == 1 {
+		version = 3.1
+	}
+	capture, err := NewCaptureWriter(w, version)
+	if err != nil {
+		return err
+	}
+
+	conn.capture.Store(capture)
+	return nil
+}
+
+// captureWriter returns the connection's
+// capture in progress, if any.
+func (conn *connV3) captureWriter() *CaptureWriter {
+	capture, _ := conn.capture.Load().(*CaptureWriter)
+	return capture
+}
+
+// SetCapture is used to record the connection's frames
+// to w, in the format described by CaptureWriter. A nil
+// io.Writer stops any capture in progress.
+func (conn *connV2) SetCapture(w io.Writer) error {
+	if w == nil {
+		conn.capture.Store((*CaptureWriter)(nil))
+		return nil
+	}
+
+	capture, err := NewCaptureWriter(w, 2)
+	if err != nil {
+		return err
+	}
+
+	conn.capture.Store(capture)
+	return nil
+}
+
+// captureWriter returns the connection's
+// capture in progress, if any.
+func (conn *connV2) captureWriter() *CaptureWriter {
+	capture, _ := conn.capture.Load().(*CaptureWriter)
+	return capture
+}
+
+// ReplayDivergence describes a point at which a replayed
+// session differs from its capture. Index is the position
+// of the expected record in the capture. If no frame was
+// received in its place, Received is nil and Err gives the
+// reason.
+type ReplayDivergence struct {
+	Index    int
+	Expected Frame
+	Received Frame
+	Err      error
+}
+
+func (d *ReplayDivergence) String() string {
+	if d.Received == nil {
+		return fmt.Sprintf("Record %d: expected %s, received nothing (%v).", d.Index, d.Expected.Name(), d.Err)
+	}
+	return fmt.Sprintf("Record %d: expected:\n%s\nreceived:\n%s", d.Index, d.Expected, d.Received)
+}
+
+// Replay plays the part of the endpoint that made the capture,
+// sending its frames over conn and comparing the frames received
+// against those in the capture. This can be used to replay a
+// client's session against a server, or a server's session
+// towards a client. Headers are compressed with fresh compression
+// state, as on a new connection.
+//
+// If timing is true, the delays between frames sent in the
+// original session are reproduced. timeout is the longest Replay
+// will wait for each expected frame; a timeout of 0 waits
+// indefinitely. The returned divergences are in capture order.
+func Replay(conn net.Conn, capture *CaptureReader, timing bool, timeout time.Duration) ([]*ReplayDivergence, error) {
+	if conn == nil {
+		return nil, ErrConnNil
+	}
+
+	compressor := NewCompressor(capture.version)
+	defer compressor.Close()
+	decompressor := NewDecompressor(capture.version)
+	buf := bufio.NewReader(conn)
+
+	var divergences []*ReplayDivergence
+	var last time.Time
+	for i := 0; ; i++ {
+		record, err := capture.ReadRecord()
+		if err == io.EOF {
+			return divergences, nil
+		}
+		if err != nil {
+			return divergences, err
+		}
+
+		if !record.Inbound {
+			if timing && !last.IsZero() {
+				time.Sleep(record.Time.Sub(last))
+			}
+			last = record.Time
+
+			if err = record.Frame.Compress(compressor); err != nil {
+				return divergences, err
+			}
+			if _, err = record.Frame.WriteTo(conn); err != nil {
+				return divergences, err
+			}
+			continue
+		}
+
+		if timeout != 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		var frame Frame
+		switch capture.version {
+		case 3:
+			frame, err = readFrameV3(buf, capture.subversion)
+		case 2:
+			frame, err = readFrameV2(buf)
+		}
+		if err == nil {
+			err = frame.Decompress(decompressor)
+		}
+		if err != nil {
+			divergences = append(divergences, &ReplayDivergence{i, record.Frame, nil, err})
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return divergences, nil
+		}
+
+		if frame.String() != record.Frame.String() {
+			divergences = append(divergences, &ReplayDivergence{i, record.Frame, frame, nil})
+		}
+	}
+}
+
+// captureFrame returns a copy of the given frame, with any
+// compressed name/value header block removed, so that the
+// frame can be compressed again without affecting the
+// original.
+func captureFrame(frame Frame) Frame {
+	switch frame := frame.(type) {
+	case *synStreamFrameV3:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	case *synStreamFrameV3_1:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	case *synReplyFrameV3:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	case *headersFrameV3:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	case *synStreamFrameV2:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	case *synReplyFrameV2:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	case *headersFrameV2:
+		out := *frame
+		out.Header = cloneHeader(frame.Header)
+		out.rawHeader = nil
+		return &out
+	default:
+		return frame
+	}
+}
+
+// plainCompressor produces uncompressed name/value
+// header blocks, for use in capture files.
+type plainCompressor struct {
+	version uint16
+}
+
+func (c *plainCompressor) Compress(h http.Header) ([]byte, error) {
+	size := 4
+	if c.version == 2 {
+		size = 2
+	}
+	putInt := func(buf *bytes.Buffer, n int) {
+		if size == 4 {
+			buf.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		} else {
+			buf.Write([]byte{byte(n >> 8), byte(n)})
+		}
+	}
+
+	// Sort the names so that captures are deterministic.
+	names := make([]string, 0, len(h))
+	for name := range h {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	putInt(buf, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], "\x00")
+		putInt(buf, len(name))
+		buf.WriteString(strings.ToLower(name))
+		putInt(buf, len(value))
+		buf.WriteString(value)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *plainCompressor) Close() error {
+	return nil
+}
+
+// plainDecompressor parses uncompressed name/value
+// header blocks, as stored in capture files.
+type plainDecompressor struct {
+	version uint16
+}
+
+func (d *plainDecompressor) Decompress(data []byte) (http.Header, error) {
+	size := 4
+	if d.version == 2 {
+		size = 2
+	}
+	r := bytes.NewReader(data)
+	readInt := func() (int, error) {
+		b, err := read(r, size)
+		if err != nil {
+			return 0, err
+		}
+		if size == 4 {
+			return int(bytesToUint32(b)), nil
+		}
+		return int(bytesToUint16(b)), nil
+	}
+
+	pairs, err := readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	for i := 0; i < pairs; i++ {
+		length, err := readInt()
+		if err != nil {
+			return nil, err
+		}
+		if length > r.Len() {
+			return nil, errors.New("Error: Incorrect header name length.")
+		}
+		name, err := read(r, length)
+		if err != nil {
+			return nil, err
+		}
+
+		length, err = readInt()
+		if err != nil {
+			return nil, err
+		}
+		if length > r.Len() {
+			return nil, errors.New("Error: Incorrect header values length.")
+		}
+		values, err := read(r, length)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, value := range bytes.Split(values, []byte{'\x00'}) {
+			header.Add(string(name), string(value))
+		}
+	}
+
+	return header, nil
+}
@@ -5,11 +5,11 @@
 package spdy
 
 import (
-	"bufio"
 	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
+	"time"
 )
 
 // init modifies http.DefaultClient to use a spdy.Transport, enabling
@@ -32,7 +32,7 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = nil
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.buf, out.counter = newFrameReader(conn)
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -47,7 +47,8 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
-		out.pings = make(map[uint32]chan<- Ping)
+		out.pings = make(map[uint32]chan time.Duration)
+		out.pingSent = make(map[uint32]time.Time)
 		out.nextPingID = 1
 		out.compressor = NewCompressor(3)
 		out.decompressor = NewDecompressor(3)
@@ -61,6 +62,9 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.pushReceiver = push
 		out.pushRequests = make(map[StreamID]*http.Request)
 		out.stop = make(chan bool)
+		out.accepted = make(chan *rawStreamV3, rawStreamBacklog)
+		out.stats = newConnStats(nil)
+		out.priorities = make(map[StreamID]Priority)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV3)
@@ -77,7 +81,7 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = nil
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.buf, out.counter = newFrameReader(conn)
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -92,7 +96,8 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
-		out.pings = make(map[uint32]chan<- Ping)
+		out.pings = make(map[uint32]chan time.Duration)
+		out.pingSent = make(map[uint32]time.Time)
 		out.nextPingID = 1
 		out.compressor = NewCompressor(3)
 		out.decompressor = NewDecompressor(3)
@@ -102,11 +107,15 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.oddity = 1
 		out.initialWindowSize = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
 		out.connectionWindowSize = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+		out.windowGrown = make(chan struct{}, 1)
 		out.requestStreamLimit = newStreamLimit(NO_STREAM_LIMIT)
 		out.pushStreamLimit = newStreamLimit(DEFAULT_STREAM_LIMIT)
 		out.pushReceiver = push
 		out.pushRequests = make(map[StreamID]*http.Request)
 		out.stop = make(chan bool)
+		out.accepted = make(chan *rawStreamV3, rawStreamBacklog)
+		out.stats = newConnStats(nil)
+		out.priorities = make(map[StreamID]Priority)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV3)
@@ -124,7 +133,7 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = nil
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.buf, out.counter = newFrameReader(conn)
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -139,7 +148,8 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
-		out.pings = make(map[uint32]chan<- Ping)
+		out.pings = make(map[uint32]chan time.Duration)
+		out.pingSent = make(map[uint32]time.Time)
 		out.nextPingID = 1
 		out.compressor = NewCompressor(2)
 		out.decompressor = NewDecompressor(2)
@@ -153,6 +163,7 @@ func NewClientConn(conn net.Conn, push Receiver, version float64) (spdyConn Conn
 		out.pushReceiver = push
 		out.pushRequests = make(map[StreamID]*http.Request)
 		out.stop = make(chan bool)
+		out.stats = newConnStats(nil)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV2)
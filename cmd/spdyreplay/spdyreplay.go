@@ -0,0 +1,105 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command spdyreplay replays a SPDY session recorded with
+// spdy.Conn.SetCapture, and reports where the responses
+// differ from those in the capture.
+//
+// To replay a client's session against a server:
+//
+//	spdyreplay -capture client.cap -connect example.com:443
+//
+// To act as the server towards a client:
+//
+//	spdyreplay -capture server.cap -listen :10443 -cert cert.pem -key key.pem
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+var npn = map[float64]string{
+	2:   "spdy/2",
+	3:   "spdy/3",
+	3.1: "spdy/3.1",
+}
+
+func handle(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func main() {
+	capture := flag.String("capture", "", "capture file to replay")
+	connect := flag.String("connect", "", "address of the server to replay a client capture against")
+	listen := flag.String("listen", "", "address on which to replay a server capture to a client")
+	certFile := flag.String("cert", "cert.pem", "TLS certificate, used with -listen")
+	keyFile := flag.String("key", "key.pem", "TLS private key, used with -listen")
+	plain := flag.Bool("plain", false, "do not use TLS")
+	insecure := flag.Bool("insecure", false, "skip verification of the server's certificate")
+	timing := flag.Bool("timing", false, "reproduce the delays between frames in the capture")
+	timeout := flag.Duration("timeout", 5*time.Second, "time to wait for each expected frame")
+	flag.Parse()
+
+	if *capture == "" || (*connect == "") == (*listen == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*capture)
+	handle(err)
+	defer f.Close()
+
+	reader, err := spdy.NewCaptureReader(f)
+	handle(err)
+
+	config := &tls.Config{
+		NextProtos:         []string{npn[reader.Version()]},
+		InsecureSkipVerify: *insecure,
+	}
+
+	var conn net.Conn
+	if *connect != "" {
+		if *plain {
+			conn, err = net.Dial("tcp", *connect)
+		} else {
+			conn, err = tls.Dial("tcp", *connect, config)
+		}
+		handle(err)
+	} else {
+		listener, err := net.Listen("tcp", *listen)
+		handle(err)
+		if !*plain {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			handle(err)
+			config.Certificates = []tls.Certificate{cert}
+			listener = tls.NewListener(listener, config)
+		}
+		conn, err = listener.Accept()
+		handle(err)
+		listener.Close()
+	}
+	defer conn.Close()
+
+	divergences, err := spdy.Replay(conn, reader, *timing, *timeout)
+	for _, divergence := range divergences {
+		fmt.Println(divergence)
+	}
+	handle(err)
+
+	if len(divergences) > 0 {
+		fmt.Printf("%d frames diverged from the capture.\n", len(divergences))
+		os.Exit(1)
+	}
+	fmt.Println("Session matched the capture.")
+}
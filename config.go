@@ -0,0 +1,166 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerConfig contains the SPDY-specific configuration
+// for an http.Server. It is registered with ConfigureServer.
+type ServerConfig struct {
+	// PingInterval, if non-zero, is the interval at which
+	// keepalive PINGs are sent on each connection.
+	PingInterval time.Duration
+
+	// MaxMissedPings is the number of consecutive keepalive
+	// PINGs which may go unanswered before the connection is
+	// closed. If zero, 1 is used.
+	MaxMissedPings int
+
+	// IdleTimeout, if non-zero, is the time after which a
+	// connection with no active streams is closed. If zero,
+	// the http.Server's IdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// RequestTimeout, if non-zero, is the maximum time allowed
+	// to receive each request and run its handler. Streams
+	// which take longer are reset with RequestTimeoutStatus.
+	RequestTimeout time.Duration
+
+	// RequestTimeoutStatus is the RST_STREAM status sent when
+	// RequestTimeout is exceeded. If zero, RST_STREAM_CANCEL
+	// is used.
+	RequestTimeoutStatus StatusCode
+
+	// PushPreload, if set, causes each response's Link
+	// headers to be inspected when its headers are sent.
+	// Each same-origin resource with rel=preload, and
+	// without the nopush attribute, is pushed to the
+	// client, using the server's Handler to serve it.
+	PushPreload bool
+
+	// PushPolicy, if non-nil, learns which resources are
+	// fetched after each page, and pushes them when the
+	// page is loaded again.
+	PushPolicy *PushPolicy
+}
+
+// serverState holds the state kept for each
+// http.Server serving SPDY, until the server is
+// shut down or released with ReleaseServer.
+type serverState struct {
+	config *ServerConfig // set by ConfigureServer, or nil.
+	stats  *connStats    // aggregate stats for the server's connections.
+}
+
+var servers = struct {
+	sync.Mutex
+	m map[*http.Server]*serverState
+}{m: make(map[*http.Server]*serverState)}
+
+// stateForServer returns the state for
+// srv, creating it if necessary.
+func stateForServer(srv *http.Server) *serverState {
+	servers.Lock()
+	defer servers.Unlock()
+	state, ok := servers.m[srv]
+	if !ok {
+		state = new(serverState)
+		state.stats = newConnStats(nil)
+		servers.m[srv] = state
+		if srv != nil {
+			srv.RegisterOnShutdown(func() {
+				ReleaseServer(srv)
+			})
+		}
+	}
+	return state
+}
+
+// ReleaseServer discards the SPDY state held for srv,
+// including its configuration and aggregate statistics.
+// This is done automatically when srv is shut down with
+// Shutdown, and should be done after Close if srv will
+// not be used again. Connections still being served
+// continue to use the released state.
+func ReleaseServer(srv *http.Server) {
+	servers.Lock()
+	defer servers.Unlock()
+	delete(servers.m, srv)
+}
+
+// ConfigureServer sets the SPDY configuration for srv. This
+// must be called before srv begins serving, and is used
+// alongside AddSPDY. A nil config restores the defaults.
+// The configuration is held until srv is released, as
+// described for ReleaseServer.
+func ConfigureServer(srv *http.Server, config *ServerConfig) {
+	state := stateForServer(srv)
+	servers.Lock()
+	defer servers.Unlock()
+	state.config = config
+}
+
+// serverConfig returns the ServerConfig for srv,
+// or the default configuration if none was set.
+func serverConfig(srv *http.Server) *ServerConfig {
+	servers.Lock()
+	defer servers.Unlock()
+	if state, ok := servers.m[srv]; ok && state.config != nil {
+		return state.config
+	}
+	return new(ServerConfig)
+}
+
+// configure applies the server's configuration
+// to a new connection.
+func (conn *connV3) configure(srv *http.Server) {
+	config := serverConfig(srv)
+	if config.PingInterval > 0 {
+		conn.SetKeepAlive(config.PingInterval, config.MaxMissedPings)
+	}
+	if config.IdleTimeout > 0 {
+		conn.SetIdleTimeout(config.IdleTimeout)
+	} else if srv != nil {
+		conn.SetIdleTimeout(srv.IdleTimeout)
+	}
+	conn.requestTimeout = config.RequestTimeout
+	conn.timeoutStatus = config.RequestTimeoutStatus
+	if conn.timeoutStatus == 0 {
+		conn.timeoutStatus = RST_STREAM_CANCEL
+	}
+	conn.pushPreload = config.PushPreload
+	if config.PushPolicy != nil {
+		conn.pushPolicy = config.PushPolicy
+		conn.pushHistory = newPushHistory()
+	}
+}
+
+// configure applies the server's configuration
+// to a new connection.
+func (conn *connV2) configure(srv *http.Server) {
+	config := serverConfig(srv)
+	if config.PingInterval > 0 {
+		conn.SetKeepAlive(config.PingInterval, config.MaxMissedPings)
+	}
+	if config.IdleTimeout > 0 {
+		conn.SetIdleTimeout(config.IdleTimeout)
+	} else if srv != nil {
+		conn.SetIdleTimeout(srv.IdleTimeout)
+	}
+	conn.requestTimeout = config.RequestTimeout
+	conn.timeoutStatus = config.RequestTimeoutStatus
+	if conn.timeoutStatus == 0 {
+		conn.timeoutStatus = RST_STREAM_CANCEL
+	}
+	conn.pushPreload = config.PushPreload
+	if config.PushPolicy != nil {
+		conn.pushPolicy = config.PushPolicy
+		conn.pushHistory = newPushHistory()
+	}
+}
@@ -23,6 +23,12 @@ var (
 	ErrNoFlowControl  = errors.New("Error: This connection does not use flow control.")
 	ErrConnectFail    = errors.New("Error: Failed to connect.")
 	ErrInvalidVersion = errors.New("Error: Invalid SPDY version.")
+	ErrConnClosed     = errors.New("Error: Conn has been closed.")
+	ErrClientOnly     = errors.New("Error: Only clients can send requests.")
+	ErrServerOnly     = errors.New("Error: Only servers can send pushes.")
+	ErrPingTimeout    = errors.New("Error: Keepalive PINGs went unanswered.")
+	ErrNoRawStreams   = errors.New("Error: This connection does not support raw streams.")
+	ErrRawStreamsOff  = errors.New("Error: Raw streams have not been enabled with SetRawStreams.")
 )
 
 // SPDY version of this implementation.
@@ -246,8 +252,6 @@ func statusCodeIsFatal(code StatusCode) bool {
 	switch code {
 	case RST_STREAM_PROTOCOL_ERROR:
 		return true
-	case RST_STREAM_INTERNAL_ERROR:
-		return true
 	case RST_STREAM_FRAME_TOO_LARGE:
 		return true
 	case RST_STREAM_UNSUPPORTED_VERSION:
@@ -0,0 +1,122 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"net/http"
+)
+
+// StreamInfo describes the SPDY stream used to serve a
+// request. It is stored in the context of each request
+// passed to a server's Handler, where it can be found with
+// StreamInfoFromContext, even if the ResponseWriter has
+// been wrapped by middleware.
+//
+// Priority is the stream's priority when the request was
+// received. CanPush indicates whether the client allowed
+// server pushes at that time.
+//
+// A StreamInfo is also stored in the context of each server
+// push request passed to a client's PushReceiver. Its Stream
+// is nil, as the push is handled by the connection.
+type StreamInfo struct {
+	Conn     Conn
+	Stream   Stream
+	StreamID StreamID
+	Priority Priority
+	Version  float64
+	CanPush  bool
+}
+
+// contextKey is used for the context values
+// set by this package.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string {
+	return "spdy context value " + k.name
+}
+
+// streamInfoKey is the context key for a request's StreamInfo.
+var streamInfoKey = &contextKey{"stream-info"}
+
+// StreamInfoFromContext returns the StreamInfo stored in ctx,
+// if any. This is present in the context of requests served
+// using SPDY.
+//
+// A simple example of checking for SPDY in middleware is:
+//
+//	func middleware(h http.Handler) http.Handler {
+//	        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	                if info, ok := spdy.StreamInfoFromContext(r.Context()); ok {
+//	                        log.Printf("Stream %d using SPDY/%v.\n", info.StreamID, info.Version)
+//	                }
+//	                h.ServeHTTP(w, r)
+//	        })
+//	}
+func StreamInfoFromContext(ctx context.Context) (*StreamInfo, bool) {
+	info, ok := ctx.Value(streamInfoKey).(*StreamInfo)
+	return info, ok
+}
+
+// newStreamContext returns a child of parent carrying
+// the StreamInfo for the given server stream.
+func newStreamContext(parent context.Context, stream Stream, canPush bool) context.Context {
+	info := &StreamInfo{
+		Conn:     stream.Conn(),
+		Stream:   stream,
+		StreamID: stream.StreamID(),
+		Priority: stream.Priority(),
+		Version:  connVersion(stream.Conn()),
+		CanPush:  canPush,
+	}
+	return context.WithValue(parent, streamInfoKey, info)
+}
+
+// rwUnwrapper is implemented by ResponseWriters that wrap
+// another, as used by http.ResponseController.
+type rwUnwrapper interface {
+	Unwrap() http.ResponseWriter
+}
+
+// streamFrom returns the SPDY stream underlying w,
+// unwrapping any ResponseWriters added by middleware.
+func streamFrom(w http.ResponseWriter) (Stream, bool) {
+	for w != nil {
+		if stream, ok := w.(Stream); ok {
+			return stream, true
+		}
+		u, ok := w.(rwUnwrapper)
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	return nil, false
+}
+
+// connVersion returns the SPDY version
+// being used by conn, or 0 if unknown.
+func connVersion(conn Conn) float64 {
+	switch conn := conn.(type) {
+	case *connV3:
+		switch conn.subversion {
+		case 0:
+			return 3
+		case 1:
+			return 3.1
+		default:
+			return 0
+		}
+
+	case *connV2:
+		return 2
+
+	default:
+		return 0
+	}
+}
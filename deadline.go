@@ -0,0 +1,75 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// deadline implements one of a stream's read or write
+// deadlines. Once the deadline passes, err returns
+// os.ErrDeadlineExceeded until a new deadline is set.
+type deadline struct {
+	sync.Mutex
+	timer    *time.Timer
+	exceeded bool
+}
+
+// set replaces the deadline with t, calling expire once
+// t has passed. A zero t removes the deadline.
+func (d *deadline) set(t time.Time, expire func()) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.stopTimer()
+	d.exceeded = false
+	if t.IsZero() {
+		return
+	}
+
+	// The timer cannot fire until d is unlocked, by
+	// which time d.timer has been set.
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(t), func() {
+		d.Lock()
+		if d.timer != timer {
+			// The deadline has since been changed.
+			d.Unlock()
+			return
+		}
+		d.timer = nil
+		d.exceeded = true
+		d.Unlock()
+		expire()
+	})
+	d.timer = timer
+}
+
+// err returns os.ErrDeadlineExceeded if the
+// deadline has passed.
+func (d *deadline) err() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exceeded {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// stop stops the deadline's timer, if any.
+func (d *deadline) stop() {
+	d.Lock()
+	defer d.Unlock()
+	d.stopTimer()
+}
+
+func (d *deadline) stopTimer() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
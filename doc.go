@@ -107,29 +107,25 @@ Use SPDY's pinging features to test the connection:
 		package main
 
 		import (
+			"context"
 			"github.com/SlyMarbo/spdy"
+			"log"
 			"net/http"
 			"time"
 		)
 
 		func Serve(w http.ResponseWriter, r *http.Request) {
-			// Ping returns a channel which will send a bool.
-			ping, err := spdy.PingClient(w)
-			if err != nil {
+			// PingClient returns the round-trip time.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			rtt, err := spdy.PingClient(ctx, w)
+			if err == spdy.ErrNotSPDY {
 				// Not using SPDY.
-			}
-
-			select {
-			case _, ok := <- ping:
-				if ok {
-					// Connection is fine.
-				} else {
-					// Something went wrong.
-				}
-
-			case <-time.After(timeout):
-				// Ping took too long.
-
+			} else if err != nil {
+				// Something went wrong, or the ping took too long.
+			} else {
+				// Connection is fine.
+				log.Printf("Round-trip time: %v.\n", rtt)
 			}
 
 			// ...
@@ -147,7 +143,7 @@ Sending a server push:
 
 		func Serve(w http.ResponseWriter, r *http.Request) {
 			// Push returns a separate http.ResponseWriter and an error.
-			path := r.URL.Scheme + "://" + r.URL.Host + "/example.js"
+			path := "https://" + r.Host + "/example.js"
 			push, err := spdy.Push(path)
 			if err != nil {
 				// Not using SPDY.
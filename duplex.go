@@ -0,0 +1,333 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DuplexStream is a client request whose body is sent while
+// the response is being received. It is created with the
+// Conn's RequestDuplex method. The request's Body is not
+// used.
+//
+// The request body is written with Write, and finished with
+// CloseWrite, which sends FIN. The response is returned by
+// Response once its headers have arrived, and its Body can
+// be read as the data arrives, until the server sends FIN.
+// The two directions are independent, so either side may
+// finish first.
+//
+// Close cancels the stream if either side has not finished.
+type DuplexStream struct {
+	stream   clientStream
+	response *duplexResponse
+}
+
+// clientStream is implemented by the client streams
+// of each SPDY version.
+type clientStream interface {
+	Stream
+
+	// closeWrite sends FIN once any
+	// buffered data has been sent.
+	closeWrite() error
+
+	// wait blocks until the server has
+	// finished the response, or the stream
+	// is closed, returning the reason for
+	// any reset.
+	wait() error
+}
+
+func newDuplexStream(stream clientStream, response *duplexResponse) *DuplexStream {
+	d := &DuplexStream{stream: stream, response: response}
+	go func() {
+		err := stream.wait()
+		if err == nil {
+			err = &StreamError{ID: stream.StreamID(), Status: RST_STREAM_CANCEL}
+		}
+		response.finish(err)
+	}()
+	return d
+}
+
+// Write sends data in the request body.
+func (d *DuplexStream) Write(b []byte) (int, error) {
+	return d.stream.Write(b)
+}
+
+// CloseWrite finishes the request body, sending FIN
+// once any data held back by flow control has been
+// sent. The response may continue to be read.
+func (d *DuplexStream) CloseWrite() error {
+	return d.stream.closeWrite()
+}
+
+// Response waits for the response headers, returning the
+// response. Its Body returns the response data as it
+// arrives, and io.EOF once the server has sent FIN.
+// Closing the Body before then cancels the stream.
+func (d *DuplexStream) Response() (*http.Response, error) {
+	return d.response.wait(d)
+}
+
+// Close cancels the stream with RST_STREAM, unless both
+// sides have already finished.
+func (d *DuplexStream) Close() error {
+	return d.stream.Close()
+}
+
+// Stream returns the underlying stream.
+func (d *DuplexStream) Stream() Stream {
+	return d.stream
+}
+
+// SetReadDeadline sets the time by which the response
+// must have been received. See Stream.SetReadDeadline.
+func (d *DuplexStream) SetReadDeadline(t time.Time) error {
+	return d.stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the time by which the request
+// must have been sent. See Stream.SetWriteDeadline.
+func (d *DuplexStream) SetWriteDeadline(t time.Time) error {
+	return d.stream.SetWriteDeadline(t)
+}
+
+// duplexResponse is the Receiver for a DuplexStream. It
+// parses the response headers as a response does, but
+// passes the data to the Body as it arrives.
+type duplexResponse struct {
+	response
+	body      *bodyBuffer
+	gotHeader chan struct{}
+	once      sync.Once
+}
+
+func newDuplexResponse(request *http.Request, statusHeader, versionHeader string) *duplexResponse {
+	r := new(duplexResponse)
+	r.Request = request
+	r.Data = new(bytes.Buffer)
+	r.statusHeader = statusHeader
+	r.versionHeader = versionHeader
+	r.body = newBodyBuffer()
+	r.gotHeader = make(chan struct{})
+	return r
+}
+
+func (r *duplexResponse) ReceiveData(req *http.Request, data []byte, final bool) {
+	r.Lock()
+	if len(data) > 0 {
+		r.gotData = true
+	}
+	r.Unlock()
+
+	r.body.Write(data)
+	if final {
+		r.received()
+		r.body.finish(nil)
+	}
+}
+
+func (r *duplexResponse) ReceiveHeader(req *http.Request, header http.Header) {
+	r.response.ReceiveHeader(req, header)
+
+	r.Lock()
+	status := r.StatusCode
+	r.Unlock()
+	if status != 0 {
+		r.received()
+	}
+}
+
+func (r *duplexResponse) ReceiveRequest(*http.Request) bool {
+	return false
+}
+
+// received marks the response headers
+// as having been received.
+func (r *duplexResponse) received() {
+	r.once.Do(func() {
+		close(r.gotHeader)
+	})
+}
+
+// finish ends the response body with err,
+// if it has not already been finished.
+func (r *duplexResponse) finish(err error) {
+	r.body.finish(err)
+	r.received()
+}
+
+// wait waits for the response headers to be
+// received, then returns the response for d.
+func (r *duplexResponse) wait(d *DuplexStream) (*http.Response, error) {
+	<-r.gotHeader
+
+	r.Lock()
+	defer r.Unlock()
+	if r.StatusCode == 0 {
+		if err := r.body.ended(); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, errors.New("Error: Stream finished without a response.")
+	}
+
+	out := r.response.Response()
+	out.Body = &duplexBody{stream: d, response: r, out: out}
+	return out, nil
+}
+
+// duplexBody is the Body of a DuplexStream's response.
+type duplexBody struct {
+	stream   *DuplexStream
+	response *duplexResponse
+	out      *http.Response
+}
+
+func (b *duplexBody) Read(p []byte) (int, error) {
+	n, err := b.response.body.Read(p)
+	if err == io.EOF {
+		// Received trailers become available
+		// once the body has been read.
+		r := b.response
+		r.Lock()
+		for name, values := range r.trailer {
+			if b.out.Trailer == nil {
+				b.out.Trailer = make(http.Header)
+			}
+			b.out.Trailer[name] = values
+		}
+		r.Unlock()
+	}
+	return n, err
+}
+
+// Close cancels the stream if the response
+// is still being received.
+func (b *duplexBody) Close() error {
+	if b.response.body.ended() == nil {
+		return b.stream.Close()
+	}
+	return nil
+}
+
+// bodyBuffer holds a message body as it is received, so
+// that it can be read before it is complete. Reads block
+// until more data arrives, or the body is finished.
+type bodyBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+}
+
+func newBodyBuffer() *bodyBuffer {
+	b := new(bodyBuffer)
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write adds received data to the body. Data
+// received after the body is finished is
+// discarded.
+func (b *bodyBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.buf.Write(p)
+		b.cond.Broadcast()
+	}
+	return len(p), nil
+}
+
+// Read reads the body, waiting for data if none
+// has yet been received. Once the body has been
+// finished with FIN, Read returns io.EOF once the
+// remaining data has been read. If the body ends
+// some other way, the error is returned at once.
+func (b *bodyBuffer) Read(p []byte) (int, error) {
+	return b.readBefore(p, nil)
+}
+
+// readBefore is Read, but returns the deadline's error
+// once it has passed, if no data has been received. If d
+// is non-nil, wake must be called when it expires.
+func (b *bodyBuffer) readBefore(p []byte, d *deadline) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil {
+		if d != nil {
+			if err := d.err(); err != nil {
+				return 0, err
+			}
+		}
+		b.cond.Wait()
+	}
+	if b.err != nil && b.err != io.EOF {
+		return 0, b.err
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+// wake wakes any blocked reads, so that
+// they check their deadlines.
+func (b *bodyBuffer) wake() {
+	b.mu.Lock()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// Close does nothing, as the body is
+// discarded with its stream.
+func (b *bodyBuffer) Close() error {
+	return nil
+}
+
+// Len returns the number of bytes
+// received but not yet read.
+func (b *bodyBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// finish ends the body. If err is nil, the body
+// is complete, and any remaining data can still
+// be read. Otherwise, the remaining data is
+// discarded and reads return err. Only the first
+// call has any effect.
+func (b *bodyBuffer) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	} else {
+		b.buf.Reset()
+	}
+	b.err = err
+	b.cond.Broadcast()
+}
+
+// ended returns the reason the body ended, which
+// is io.EOF if it is complete, or nil if it is
+// still being received.
+func (b *bodyBuffer) ended() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
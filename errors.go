@@ -0,0 +1,96 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"fmt"
+)
+
+// StreamError is used to report the failure of a single
+// stream. ID is the stream's ID, or 0 if the stream could
+// not be opened, and Status is the RST_STREAM status code
+// describing the failure.
+//
+// StreamErrors can be detected with errors.As:
+//
+//	var streamErr *spdy.StreamError
+//	if errors.As(err, &streamErr) && streamErr.Status == spdy.RST_STREAM_REFUSED_STREAM {
+//	        // Retry the request.
+//	}
+type StreamError struct {
+	ID     StreamID
+	Status StatusCode
+}
+
+func (e *StreamError) Error() string {
+	if e.ID == 0 {
+		return fmt.Sprintf("Error: Stream could not be opened (%s).", e.Status)
+	}
+	return fmt.Sprintf("Error: Stream %d failed (%s).", e.ID, e.Status)
+}
+
+// ConnectionError is used to report the failure of a whole
+// connection, and is returned by Conn.Run. GoawayStatus and
+// LastGoodStreamID are those of the GOAWAY sent or received,
+// and any streams with higher IDs were not processed by the
+// other endpoint, so may be retried. Cause is the underlying
+// error, if any. If the other endpoint sent the GOAWAY, then
+// Cause is ErrGoaway.
+type ConnectionError struct {
+	GoawayStatus     StatusCode
+	LastGoodStreamID StreamID
+	Cause            error
+}
+
+func (e *ConnectionError) Error() string {
+	status := goawayStatusText[e.GoawayStatus]
+	if status == "" {
+		status = fmt.Sprintf("status %d", e.GoawayStatus)
+	}
+	if e.Cause == nil {
+		return fmt.Sprintf("Error: Connection ended with %s after stream %d.", status, e.LastGoodStreamID)
+	}
+	return fmt.Sprintf("Error: Connection ended with %s after stream %d: %v", status, e.LastGoodStreamID, e.Cause)
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *ConnectionError) Unwrap() error {
+	return e.Cause
+}
+
+var goawayStatusText = map[StatusCode]string{
+	GOAWAY_OK:                 "OK",
+	GOAWAY_PROTOCOL_ERROR:     "PROTOCOL_ERROR",
+	GOAWAY_INTERNAL_ERROR:     "INTERNAL_ERROR",
+	GOAWAY_FLOW_CONTROL_ERROR: "FLOW_CONTROL_ERROR",
+}
+
+// closeWithError closes the connection, recording
+// err as the reason, which is then returned by Run.
+func closeWithError(conn Conn, err error) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.setError(err)
+	case *connV2:
+		conn.setError(err)
+	}
+	conn.Close()
+}
+
+// closeResetStream closes a stream that the other endpoint
+// has reset with RST_STREAM. Client and raw streams record status,
+// so that it is reported to the caller as a *StreamError.
+func closeResetStream(stream Stream, status StatusCode) {
+	switch stream := stream.(type) {
+	case *clientStreamV3:
+		stream.resetByPeer(status)
+	case *clientStreamV2:
+		stream.resetByPeer(status)
+	case *rawStreamV3:
+		stream.resetByPeer(status)
+	default:
+		stream.Close()
+	}
+}
@@ -7,6 +7,7 @@ package spdy
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 // Objects conforming to the FlowControl interface can be
@@ -60,9 +61,13 @@ type flowControl struct {
 	sent                uint32
 	buffer              [][]byte
 	constrained         bool
+	constrainedSince    time.Time
 	initialWindowThere  uint32
 	transferWindowThere int64
 	flowControl         FlowControl
+	stats               *connStats
+	waitLock            sync.Mutex    // protects waiting.
+	waiting             chan struct{} // closed when the stream may no longer be paused.
 }
 
 // AddFlowControl initialises flow control for
@@ -88,6 +93,9 @@ func (s *serverStreamV3) AddFlowControl(f FlowControl) {
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	if conn, ok := s.conn.(*connV3); ok {
+		s.flow.stats = conn.stats
+	}
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
 }
@@ -115,6 +123,9 @@ func (p *pushStreamV3) AddFlowControl(f FlowControl) {
 	p.flow.transferWindow = int64(initialWindow)
 	p.flow.stream = p
 	p.flow.flowControl = f
+	if conn, ok := p.conn.(*connV3); ok {
+		p.flow.stats = conn.stats
+	}
 	p.flow.initialWindowThere = f.InitialWindowSize()
 	p.flow.transferWindowThere = int64(p.flow.transferWindowThere)
 }
@@ -142,10 +153,43 @@ func (r *clientStreamV3) AddFlowControl(f FlowControl) {
 	r.flow.transferWindow = int64(initialWindow)
 	r.flow.stream = r
 	r.flow.flowControl = f
+	if conn, ok := r.conn.(*connV3); ok {
+		r.flow.stats = conn.stats
+	}
 	r.flow.initialWindowThere = f.InitialWindowSize()
 	r.flow.transferWindowThere = int64(r.flow.initialWindowThere)
 }
 
+// AddFlowControl initialises flow control for
+// the Stream. If the Stream is running at an
+// older SPDY version than SPDY/3, the flow
+// control has no effect. Multiple calls to
+// AddFlowControl are safe.
+func (s *rawStreamV3) AddFlowControl(f FlowControl) {
+	if s.flow != nil {
+		return
+	}
+
+	s.flow = new(flowControl)
+	initialWindow, err := s.conn.InitialWindowSize()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.flow.streamID = s.streamID
+	s.flow.output = s.output
+	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.initialWindow = initialWindow
+	s.flow.transferWindow = int64(initialWindow)
+	s.flow.stream = s
+	s.flow.flowControl = f
+	if conn, ok := s.conn.(*connV3); ok {
+		s.flow.stats = conn.stats
+	}
+	s.flow.initialWindowThere = f.InitialWindowSize()
+	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
+}
+
 // CheckInitialWindow is used to handle the race
 // condition where the flow control is initialised
 // before the server has received any updates to
@@ -154,6 +198,14 @@ func (r *clientStreamV3) AddFlowControl(f FlowControl) {
 // The transfer window is updated retroactively,
 // if necessary.
 func (f *flowControl) CheckInitialWindow() {
+	f.Lock()
+	defer f.Unlock()
+	f.checkInitialWindow()
+}
+
+// checkInitialWindow is CheckInitialWindow,
+// with f already locked.
+func (f *flowControl) checkInitialWindow() {
 	if f.stream == nil || f.stream.Conn() == nil {
 		return
 	}
@@ -166,12 +218,12 @@ func (f *flowControl) CheckInitialWindow() {
 
 	if f.initialWindow != newWindow {
 		if f.initialWindow > newWindow {
-			f.transferWindow = int64(newWindow - f.sent)
+			f.transferWindow = int64(newWindow) - int64(f.sent)
 		} else if f.initialWindow < newWindow {
 			f.transferWindow += int64(newWindow - f.initialWindow)
 		}
-		if f.transferWindow <= 0 {
-			f.constrained = true
+		if f.transferWindow <= 0 && !f.constrained {
+			f.constrain()
 		}
 		f.initialWindow = newWindow
 	}
@@ -179,8 +231,15 @@ func (f *flowControl) CheckInitialWindow() {
 
 // Close nils any references held by the flowControl.
 func (f *flowControl) Close() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.constrained {
+		f.unconstrain()
+	}
 	f.buffer = nil
 	f.stream = nil
+	f.wake()
 }
 
 // Flush is used to send buffered data to
@@ -189,34 +248,38 @@ func (f *flowControl) Close() {
 // that any or all buffered data will be
 // sent with a single flush.
 func (f *flowControl) Flush() {
-	f.CheckInitialWindow()
-	if !f.constrained || f.transferWindow == 0 {
+	f.Lock()
+	defer f.Unlock()
+	f.flush()
+}
+
+// flush is Flush, with f already locked. f stays
+// locked while the data is sent, so that it cannot
+// be overtaken by data from a concurrent Write.
+func (f *flowControl) flush() {
+	f.checkInitialWindow()
+	if !f.constrained || f.transferWindow <= 0 {
 		return
 	}
 
 	out := make([]byte, 0, f.transferWindow)
 	left := f.transferWindow
-	for i := 0; i < len(f.buffer); i++ {
-		if l := int64(len(f.buffer[i])); l <= left {
-			out = append(out, f.buffer[i]...)
+	for left > 0 && len(f.buffer) > 0 {
+		if l := int64(len(f.buffer[0])); l <= left {
+			out = append(out, f.buffer[0]...)
 			left -= l
 			f.buffer = f.buffer[1:]
 		} else {
-			out = append(out, f.buffer[i][:left]...)
-			f.buffer[i] = f.buffer[i][left:]
+			out = append(out, f.buffer[0][:left]...)
+			f.buffer[0] = f.buffer[0][left:]
 			left = 0
 		}
-
-		if left == 0 {
-			break
-		}
 	}
 
 	f.transferWindow -= int64(len(out))
 
 	if f.transferWindow > 0 {
-		f.constrained = false
-		log.Printf("Stream %d is no longer constrained.\n", f.streamID)
+		f.unconstrain()
 	}
 
 	dataFrame := new(dataFrameV3)
@@ -226,12 +289,58 @@ func (f *flowControl) Flush() {
 	f.output <- dataFrame
 }
 
+// constrain marks the stream as unable to send
+// data until its transfer window grows.
+func (f *flowControl) constrain() {
+	f.constrained = true
+	f.constrainedSince = time.Now()
+	debug.Printf("Stream %d is now constrained.\n", f.streamID)
+}
+
+// unconstrain marks the stream as able to send data,
+// recording the time it spent constrained.
+func (f *flowControl) unconstrain() {
+	f.constrained = false
+	if f.stats != nil {
+		f.stats.constrained(time.Since(f.constrainedSince))
+	}
+	debug.Printf("Stream %d is no longer constrained.\n", f.streamID)
+	f.wake()
+}
+
+// Wait returns a channel which is closed once the
+// stream may no longer be paused, as its buffered
+// data has been sent, it has been closed, or wake
+// has been called. Wait should be called before
+// Paused is checked, so that no change is missed.
+func (f *flowControl) Wait() <-chan struct{} {
+	f.waitLock.Lock()
+	defer f.waitLock.Unlock()
+	if f.waiting == nil {
+		f.waiting = make(chan struct{})
+	}
+	return f.waiting
+}
+
+// wake closes the channel returned by Wait,
+// so that any waiters check Paused again.
+func (f *flowControl) wake() {
+	f.waitLock.Lock()
+	defer f.waitLock.Unlock()
+	if f.waiting != nil {
+		close(f.waiting)
+		f.waiting = nil
+	}
+}
+
 // Paused indicates whether there is data buffered.
 // A Stream should not be closed until after the
 // last data has been sent and then Paused returns
 // false.
 func (f *flowControl) Paused() bool {
-	f.CheckInitialWindow()
+	f.Lock()
+	defer f.Unlock()
+	f.checkInitialWindow()
 	return f.constrained
 }
 
@@ -240,26 +349,48 @@ func (f *flowControl) Paused() bool {
 // conform to the transfer window, regrows the
 // window, and sends errors if necessary.
 func (f *flowControl) Receive(data []byte) {
+	f.Lock()
+
 	// The transfer window shouldn't already be negative.
+	var rst *rstStreamFrameV3
 	if f.transferWindowThere < 0 {
-		rst := new(rstStreamFrameV3)
+		rst = new(rstStreamFrameV3)
 		rst.StreamID = f.streamID
 		rst.Status = RST_STREAM_FLOW_CONTROL_ERROR
-		f.output <- rst
 	}
 
 	// Update the window.
 	f.transferWindowThere -= int64(len(data))
 
 	// Regrow the window if it's half-empty.
+	var grow *windowUpdateFrameV3
 	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, f.transferWindowThere)
 	if delta != 0 {
-		grow := new(windowUpdateFrameV3)
+		grow = new(windowUpdateFrameV3)
 		grow.StreamID = f.streamID
 		grow.DeltaWindowSize = delta
-		f.output <- grow
 		f.transferWindowThere += int64(grow.DeltaWindowSize)
 	}
+	output := f.output
+	f.Unlock()
+
+	if rst != nil {
+		output <- rst
+	}
+	if grow != nil {
+		output <- grow
+	}
+}
+
+// UpdateInitialWindowThere is called when a new initial
+// window size has been sent to the other endpoint, and
+// adjusts the transfer window it may use by the difference.
+func (f *flowControl) UpdateInitialWindowThere(initialWindow uint32) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.transferWindowThere += int64(initialWindow) - int64(f.initialWindowThere)
+	f.initialWindowThere = initialWindow
 }
 
 // UpdateWindow is called when an UPDATE_WINDOW frame is received,
@@ -276,7 +407,7 @@ func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
 	debug.Printf("Flow: Growing window in stream %d by %d bytes.\n", f.streamID, deltaWindowSize)
 	f.transferWindow += int64(deltaWindowSize)
 
-	f.Flush()
+	f.flush()
 	return nil
 }
 
@@ -290,31 +421,33 @@ func (f *flowControl) Write(data []byte) (int, error) {
 		return 0, nil
 	}
 
+	f.Lock()
+	defer f.Unlock()
+
 	if f.buffer == nil || f.stream == nil {
-		return 0, errors.New("Error: Stream closed.")
+		return 0, &StreamError{ID: f.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
 	}
 
 	// Transfer window processing.
-	f.CheckInitialWindow()
+	f.checkInitialWindow()
 	if f.constrained {
-		f.Flush()
+		f.flush()
 	}
-	f.Lock()
 	var window uint32
-	if f.transferWindow < 0 {
+	if f.transferWindow < 0 || len(f.buffer) > 0 {
 		window = 0
 	} else {
 		window = uint32(f.transferWindow)
 	}
-	f.Unlock()
 
 	if uint32(len(data)) > window {
 		f.buffer = append(f.buffer, data[window:])
 		data = data[:window]
 		f.sent += window
 		f.transferWindow -= int64(window)
-		f.constrained = true
-		log.Printf("Stream %d is now constrained.\n", f.streamID)
+		if !f.constrained {
+			f.constrain()
+		}
 	}
 
 	if len(data) == 0 {
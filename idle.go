@@ -0,0 +1,55 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"time"
+)
+
+// idler is implemented by connections which
+// can report whether they have active streams.
+type idler interface {
+	Conn
+	activeStreams() int
+	lastActivity() time.Time
+}
+
+// idleTimeout closes the connection once it has had no
+// active streams for the given timeout, or returns when
+// stop is closed or the connection ends. Closing the
+// connection sends a GOAWAY to the other endpoint.
+func idleTimeout(conn idler, timeout time.Duration, stop <-chan struct{}) {
+	// Check several times per timeout, so that the
+	// connection is not kept open much longer than
+	// the timeout. Very short timeouts are checked
+	// every millisecond, as the interval must be
+	// positive.
+	interval := timeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	idleSince := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-conn.CloseNotify():
+			return
+		}
+
+		if last := conn.lastActivity(); last.After(idleSince) {
+			idleSince = last
+		}
+		if time.Since(idleSince) >= timeout {
+			debug.Printf("Connection idle for %s. Closing.\n", timeout)
+			conn.Close()
+			return
+		}
+	}
+}
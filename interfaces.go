@@ -5,6 +5,7 @@
 package spdy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -23,20 +24,34 @@ import (
 // be started with a call to Run, which will return once the
 // connection has been terminated. The connection can be ended
 // early by using Close.
+//
+// Run returns the reason the connection ended, usually as a
+// *ConnectionError, or nil if it was ended locally with Close.
 type Conn interface {
 	http.CloseNotifier
 	io.Closer
+	Accept() (RawStream, error)
 	Conn() net.Conn
 	InitialWindowSize() (uint32, error)
-	Ping() (<-chan Ping, error)
+	OpenStream(header http.Header, priority Priority) (RawStream, error)
+	PeerSettings() Settings
+	Ping(context.Context) (time.Duration, error)
 	Push(url string, origin Stream) (PushStream, error)
+	PushWithOptions(url string, origin Stream, opts *PushOptions) (PushStream, error)
 	Request(request *http.Request, receiver Receiver, priority Priority) (Stream, error)
+	RequestDuplex(request *http.Request, priority Priority) (*DuplexStream, error)
 	RequestResponse(request *http.Request, receiver Receiver, priority Priority) (*http.Response, error)
 	Run() error
+	SendSettings(Settings) error
+	SetCapture(io.Writer) error
 	SetFlowControl(FlowControl) error
+	SetKeepAlive(interval time.Duration, maxMissed int)
+	SetIdleTimeout(time.Duration)
+	SetRawStreams(bool)
 	SetTimeout(time.Duration)
 	SetReadTimeout(time.Duration)
 	SetWriteTimeout(time.Duration)
+	Stats() *Stats
 }
 
 // Stream contains a single SPDY stream.
@@ -45,8 +60,12 @@ type Stream interface {
 	http.ResponseWriter
 	io.ReadCloser
 	Conn() Conn
+	Priority() Priority
 	ReceiveFrame(Frame) error
 	Run() error
+	SetPriority(Priority) error
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
 	State() *StreamState
 	StreamID() StreamID
 }
@@ -110,13 +129,6 @@ type Receiver interface {
 	ReceiveRequest(request *http.Request) bool
 }
 
-/********
- * Ping *
- ********/
-
-// Ping is used in indicating the response from a ping request.
-type Ping struct{}
-
 /************
  * StreamID *
  ************/
@@ -327,7 +339,8 @@ func (s Settings) Settings() []*Setting {
 // to effect the changes.
 type StreamState struct {
 	sync.RWMutex
-	s uint8
+	s      uint8
+	closed func() // called once the stream is closed.
 }
 
 // Check whether the stream is open.
@@ -372,7 +385,7 @@ func (s *StreamState) OpenHere() bool {
 func (s *StreamState) Close() {
 	s.Lock()
 	s.s = stateClosed
-	s.Unlock()
+	s.unlock()
 }
 
 // Half-close the stream locally.
@@ -383,7 +396,7 @@ func (s *StreamState) CloseHere() {
 	} else if s.s == stateHalfClosedThere {
 		s.s = stateClosed
 	}
-	s.Unlock()
+	s.unlock()
 }
 
 // Half-close the stream at the other endpoint.
@@ -394,7 +407,28 @@ func (s *StreamState) CloseThere() {
 	} else if s.s == stateHalfClosedHere {
 		s.s = stateClosed
 	}
+	s.unlock()
+}
+
+// onClose sets f to be called once the stream
+// is closed, or calls it now if it already is.
+func (s *StreamState) onClose(f func()) {
+	s.Lock()
+	s.closed = f
+	s.unlock()
+}
+
+// unlock unlocks the state, calling the onClose
+// func if the stream has been closed.
+func (s *StreamState) unlock() {
+	var f func()
+	if s.s == stateClosed {
+		f, s.closed = s.closed, nil
+	}
 	s.Unlock()
+	if f != nil {
+		f()
+	}
 }
 
 // State description.
@@ -0,0 +1,46 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"time"
+)
+
+// keepAlive sends a PING every interval until stop is
+// closed or the connection ends. If maxMissed consecutive
+// PINGs go unanswered within the interval, the connection
+// is assumed to be dead and is closed.
+func keepAlive(conn Conn, interval time.Duration, maxMissed int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-conn.CloseNotify():
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := conn.Ping(ctx)
+		cancel()
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		debug.Printf("Keepalive PING failed (%d of %d): %v\n", missed, maxMissed, err)
+		if missed >= maxMissed {
+			log.Printf("Warning: %d keepalive PINGs unanswered. Closing connection.\n", missed)
+			closeWithError(conn, &ConnectionError{Cause: ErrPingTimeout})
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// preloadTargets returns the targets of the Link headers in
+// header with rel=preload, which are on the same origin as
+// request and not marked nopush. Each target is returned as
+// an absolute path, suitable for http.Pusher.
+func preloadTargets(header http.Header, request *http.Request) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, value := range header["Link"] {
+		for _, link := range splitLinks(value) {
+			ref, params, ok := parseLink(link)
+			if !ok || params["nopush"] || !params["rel=preload"] {
+				continue
+			}
+
+			target, ok := sameOrigin(ref, request)
+			if ok && !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// splitLinks splits a Link header value into its
+// links, ignoring commas in URLs and quoted strings.
+func splitLinks(value string) []string {
+	var links []string
+	inURL, inQuote := false, false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case inQuote && c == '\\':
+			i++
+		case inQuote:
+			inQuote = c != '"'
+		case inURL:
+			inURL = c != '>'
+		case c == '"':
+			inQuote = true
+		case c == '<':
+			inURL = true
+		case c == ',':
+			links = append(links, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(links, value[start:])
+}
+
+// parseLink parses a single link, returning its URL
+// reference and its parameters. The parameters are
+// lower-cased, and each rel value is given as
+// "rel=<value>". Valueless parameters, such as
+// nopush, are given by name.
+func parseLink(link string) (string, map[string]bool, bool) {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(link, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	ref := strings.TrimSpace(link[1:end])
+
+	params := make(map[string]bool)
+	for _, param := range strings.Split(link[end+1:], ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name = strings.TrimSpace(param[:i])
+			value = strings.Trim(strings.TrimSpace(param[i+1:]), `"`)
+		}
+		name = strings.ToLower(name)
+		if name == "rel" {
+			for _, rel := range strings.Fields(strings.ToLower(value)) {
+				params["rel="+rel] = true
+			}
+			continue
+		}
+		params[name] = true
+	}
+
+	return ref, params, true
+}
+
+// sameOrigin resolves ref against request, returning its
+// path and query if it has the same origin as request.
+func sameOrigin(ref string, request *http.Request) (string, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Opaque != "" || u.Path == "" {
+		return "", false
+	}
+
+	if u.Host != "" {
+		scheme := "https"
+		if request.TLS == nil {
+			scheme = "http"
+		}
+		if (u.Scheme != "" && !strings.EqualFold(u.Scheme, scheme)) || !strings.EqualFold(u.Host, request.Host) {
+			return "", false
+		}
+	} else if u.Scheme != "" {
+		return "", false
+	}
+
+	// Resolve relative references against the
+	// request's path.
+	if !strings.HasPrefix(u.Path, "/") {
+		base := &url.URL{Path: request.URL.Path}
+		u.Path = base.ResolveReference(&url.URL{Path: u.Path}).Path
+		u.RawPath = ""
+	}
+
+	target := u.EscapedPath()
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return target, true
+}
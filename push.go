@@ -0,0 +1,188 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PushOptions describes a server push, for use with
+// PushWithOptions. A nil *PushOptions gives the defaults.
+type PushOptions struct {
+	// Method is the pushed request's method, which
+	// must be GET or HEAD. If empty, GET is used.
+	Method string
+
+	// Header holds the pushed request's headers, which
+	// are sent with its URL in the SYN_STREAM.
+	Header http.Header
+
+	// Priority is the priority of the push stream. If
+	// nil, the origin stream's priority is used.
+	Priority *Priority
+
+	// Status is the pushed response's status code. If
+	// zero, 200 is used. With SPDY/3, a handler writing
+	// the push may change it by calling WriteHeader
+	// before its first write.
+	Status int
+
+	// ResponseHeader holds the pushed response's
+	// headers. With SPDY/3, these are sent with the
+	// status in a HEADERS frame before any data. With
+	// SPDY/2, they are sent in the SYN_STREAM.
+	ResponseHeader http.Header
+}
+
+// pushOptions returns a copy of opts with the defaults
+// filled in, checking that they can be used for a push
+// from origin with the given SPDY version.
+func pushOptions(opts *PushOptions, origin Stream, version uint16) (*PushOptions, error) {
+	out := new(PushOptions)
+	if opts != nil {
+		*out = *opts
+	}
+
+	switch out.Method {
+	case "":
+		out.Method = "GET"
+	case "GET", "HEAD":
+	default:
+		return nil, errors.New("Error: Pushes must use the GET or HEAD method.")
+	}
+
+	if out.Priority == nil {
+		priority := origin.Priority()
+		out.Priority = &priority
+	} else if !out.Priority.Valid(version) {
+		if version == 2 {
+			return nil, errors.New("Error: Priority must be in the range 0 - 3.")
+		}
+		return nil, errors.New("Error: Priority must be in the range 0 - 7.")
+	}
+
+	if out.Status == 0 {
+		out.Status = http.StatusOK
+	} else if out.Status < 100 || out.Status > 999 {
+		return nil, errors.New("Error: Invalid push status code.")
+	}
+
+	out.Header = pushHeader(out.Header)
+	out.ResponseHeader = pushHeader(out.ResponseHeader)
+	return out, nil
+}
+
+// pushHeader returns a copy of header without
+// any headers reserved by SPDY or HTTP/1.1.
+func pushHeader(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Connection", "Host", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding",
+			"Method", "Scheme", "Status", "Url", "Version":
+			continue
+		}
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// checkPushOrigin checks that a push from origin may be
+// sent on conn. Pushes must be associated with an open
+// request stream on the same connection.
+func checkPushOrigin(conn Conn, origin Stream) error {
+	if origin == nil {
+		return errors.New("Error: Pushes must have an origin stream.")
+	}
+	if origin.Conn() != conn {
+		return errors.New("Error: Origin stream belongs to another connection.")
+	}
+	if origin.StreamID()&1 == 0 {
+		return errors.New("Error: Pushes cannot originate from a push stream.")
+	}
+	if state := origin.State(); state == nil || state.ClosedHere() {
+		return errors.New("Error: Origin stream is closed.")
+	}
+	return nil
+}
+
+// servePush implements http.Pusher for server streams.
+// The target is pushed from origin, then served by the
+// handler as though the client had requested it.
+func servePush(origin Stream, request *http.Request, handler http.Handler, target string, opts *http.PushOptions) error {
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+
+	// Resolve the target against the origin request.
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(u.Path, "/") {
+			return errors.New("Error: Push target must be an absolute path or URL.")
+		}
+		u.Scheme = "https"
+		if request.TLS == nil {
+			u.Scheme = "http"
+		}
+		u.Host = request.Host
+	}
+
+	push, err := origin.Conn().PushWithOptions(u.String(), origin, &PushOptions{Method: opts.Method, Header: opts.Header})
+	if err != nil {
+		return err
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	header := pushHeader(opts.Header)
+	pushed := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       u.Host,
+		RemoteAddr: request.RemoteAddr,
+		RequestURI: u.RequestURI(),
+		TLS:        request.TLS,
+	}
+
+	// The push outlives the origin's handler, so
+	// its context is not cancelled with the origin.
+	ctx := newStreamContext(context.WithoutCancel(request.Context()), push, false)
+	pushed = pushed.WithContext(ctx)
+
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				if v != http.ErrAbortHandler {
+					log.Printf("panic serving push of %s: %v\n", u, v)
+				}
+				if p, ok := push.(interface{ reset(StatusCode) }); ok {
+					p.reset(RST_STREAM_INTERNAL_ERROR)
+				}
+			}
+		}()
+
+		handler.ServeHTTP(push, pushed)
+		push.Finish()
+	}()
+
+	return nil
+}
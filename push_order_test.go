@@ -0,0 +1,223 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushOrderCount is the number of resources pushed by
+// the handler in the push ordering tests.
+const pushOrderCount = 50
+
+// pushOrderHandler pushes each resource at the lowest
+// priority, then names it in the origin stream's body.
+// The pushes are written concurrently, to compete with
+// the origin stream for the sender, and have finished
+// by the time the handler returns.
+func pushOrderHandler(low Priority, errs chan<- error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for i := 0; i < pushOrderCount; i++ {
+			push, err := PushWithOptions(w, fmt.Sprintf("http://example.com/res%d", i), &PushOptions{Priority: &low})
+			if err != nil {
+				errs <- err
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				push.Write([]byte("resource"))
+				push.Finish()
+			}()
+
+			fmt.Fprintf(w, "res%d\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+}
+
+// testPushOrder requests a page from a server connection
+// using the given version, reading the frames directly, and
+// checks that each push's SYN_STREAM arrives before the data
+// on the origin stream which names the pushed resource.
+func testPushOrder(t *testing.T, version float64) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	low := Priority(7)
+	if version == 2 {
+		low = 3
+	}
+	errs := make(chan error, 1)
+	srv := &http.Server{Handler: pushOrderHandler(low, errs)}
+	defer ReleaseServer(srv)
+
+	client, server := net.Pipe()
+	conn, err := NewServerConn(server, srv, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		conn.Run()
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		conn.Close()
+		<-done
+	}()
+
+	// Send the request.
+	var syn Frame
+	var decom Decompressor
+	switch version {
+	case 2:
+		frame := new(synStreamFrameV2)
+		frame.Flags = FLAG_FIN
+		frame.StreamID = 1
+		frame.Header = http.Header{
+			"method":  {"GET"},
+			"url":     {"/"},
+			"version": {"HTTP/1.1"},
+			"host":    {"example.com"},
+			"scheme":  {"http"},
+		}
+		syn = frame
+		decom = NewDecompressor(2)
+	case 3, 3.1:
+		header := http.Header{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":host":    {"example.com"},
+			":scheme":  {"http"},
+		}
+		if version == 3 {
+			syn = &synStreamFrameV3{Flags: FLAG_FIN, StreamID: 1, Header: header}
+		} else {
+			syn = &synStreamFrameV3_1{Flags: FLAG_FIN, StreamID: 1, Header: header}
+		}
+		decom = NewDecompressor(3)
+	}
+	com := NewCompressor(uint16(version))
+	defer com.Close()
+	if err := syn.Compress(com); err != nil {
+		t.Fatal(err)
+	}
+	go syn.WriteTo(client)
+
+	// Read the response, counting the pushes
+	// announced before each line of the body.
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := bufio.NewReader(client)
+	pushes := 0
+	var body []byte
+	lines := 0
+	for finished := false; !finished; {
+		var frame Frame
+		if version == 2 {
+			frame, err = readFrameV2(buf)
+		} else {
+			subversion := 0
+			if version == 3.1 {
+				subversion = 1
+			}
+			frame, err = readFrameV3(buf, subversion)
+		}
+		if err == io.EOF {
+			t.Fatal("Connection closed before the response finished.")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+
+		var sid, assoc StreamID
+		var data []byte
+		var flags Flags
+		isSyn := false
+		switch frame := frame.(type) {
+		case *synStreamFrameV2:
+			sid, assoc, flags, isSyn = frame.StreamID, frame.AssocStreamID, frame.Flags, true
+		case *synStreamFrameV3:
+			sid, assoc, flags, isSyn = frame.StreamID, frame.AssocStreamID, frame.Flags, true
+		case *synStreamFrameV3_1:
+			sid, assoc, flags, isSyn = frame.StreamID, frame.AssocStreamID, frame.Flags, true
+		case *synReplyFrameV2:
+			sid, flags = frame.StreamID, frame.Flags
+		case *synReplyFrameV3:
+			sid, flags = frame.StreamID, frame.Flags
+		case *dataFrameV2:
+			sid, data, flags = frame.StreamID, frame.Data, frame.Flags
+		case *dataFrameV3:
+			sid, data, flags = frame.StreamID, frame.Data, frame.Flags
+		default:
+			continue
+		}
+
+		if isSyn {
+			if assoc != 1 {
+				t.Fatalf("Push %d associated with stream %d, expected 1.", sid, assoc)
+			}
+			pushes++
+			continue
+		}
+		if sid != 1 {
+			continue
+		}
+
+		body = append(body, data...)
+		for {
+			i := bytes.IndexByte(body, '\n')
+			if i < 0 {
+				break
+			}
+			want := fmt.Sprintf("res%d", lines)
+			if got := string(body[:i]); got != want {
+				t.Fatalf("Received %q, expected %q.", got, want)
+			}
+			if pushes <= lines {
+				t.Fatalf("Received %q after %d pushes, expected at least %d.", want, pushes, lines+1)
+			}
+			body = body[i+1:]
+			lines++
+		}
+		finished = flags.FIN()
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if lines != pushOrderCount {
+		t.Fatalf("Received %d lines, expected %d.", lines, pushOrderCount)
+	}
+}
+
+func TestPushOrderV2(t *testing.T) {
+	testPushOrder(t, 2)
+}
+
+func TestPushOrderV3(t *testing.T) {
+	testPushOrder(t, 3)
+}
+
+func TestPushOrderV3_1(t *testing.T) {
+	testPushOrder(t, 3.1)
+}
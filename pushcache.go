@@ -0,0 +1,320 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPushCacheSize is the number of bytes a PushCache
+// may hold if its MaxBytes is zero.
+const DefaultPushCacheSize = 8 << 20
+
+// DefaultPushCacheTTL is the time for which pushed resources
+// are kept by a PushCache if its TTL is zero.
+const DefaultPushCacheTTL = time.Minute
+
+// PushCache stores the resources pushed to a Transport, so
+// that later requests for them are served without using the
+// network. It is used by setting Transport.PushCache.
+//
+// Pushed resources are keyed by their URL and the origin of
+// the connection on which they were pushed. Each is used at
+// most once, after which it is removed from the cache. A
+// request for a resource still being pushed waits for the
+// push to complete.
+type PushCache struct {
+	// MaxBytes is the maximum number of bytes of pushed
+	// response bodies stored. If zero, DefaultPushCacheSize
+	// is used. Once the limit is reached, the oldest pushes
+	// are discarded.
+	MaxBytes int64
+
+	// TTL is the time for which a pushed resource is kept,
+	// measured from the start of the push. If zero,
+	// DefaultPushCacheTTL is used.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[pushCacheKey]*pushCacheEntry
+	pushes  map[*http.Request]*pushCacheEntry
+	order   []*pushCacheEntry
+	size    int64
+}
+
+type pushCacheKey struct {
+	origin string
+	url    string
+}
+
+// pushCacheEntry holds a single pushed resource.
+type pushCacheEntry struct {
+	key       pushCacheKey
+	response  *response
+	expires   time.Time
+	done      chan struct{}
+	complete  bool
+	cancelled bool
+	taken     bool
+	size      int64
+}
+
+// Len returns the number of pushed resources
+// currently held in the cache.
+func (c *PushCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(time.Now())
+	return len(c.entries)
+}
+
+// receiver returns the Receiver used to store pushes received
+// on a connection to origin, using the given SPDY version.
+// Pushes are also passed to next, if it is non-nil.
+func (c *PushCache) receiver(origin string, version float64, next Receiver) Receiver {
+	return &pushCacheReceiver{cache: c, origin: origin, version: version, next: next}
+}
+
+// get returns the response for req, if it has been pushed on
+// a connection to origin. If the push is still in progress,
+// get waits for it to complete, the request to be cancelled,
+// or the push to expire.
+func (c *PushCache) get(origin string, req *http.Request) (*http.Response, bool) {
+	if req.Method != "GET" || (req.Body != nil && req.Body != http.NoBody) {
+		return nil, false
+	}
+	key := pushCacheKey{origin: origin, url: req.URL.String()}
+
+	c.mu.Lock()
+	c.expire(time.Now())
+	entry, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	// Each push is only used once.
+	c.take(entry)
+	complete := entry.complete
+	c.mu.Unlock()
+
+	if !complete {
+		timer := time.NewTimer(time.Until(entry.expires))
+		defer timer.Stop()
+		select {
+		case <-entry.done:
+			if entry.cancelled {
+				return nil, false
+			}
+		case <-req.Context().Done():
+			return nil, false
+		case <-timer.C:
+			return nil, false
+		}
+	}
+
+	entry.response.Lock()
+	entry.response.Request = req
+	entry.response.Unlock()
+	return entry.response.Response(), true
+}
+
+// add starts storing a push. c must be locked.
+func (c *PushCache) add(key pushCacheKey, req *http.Request, res *response) {
+	if c.entries == nil {
+		c.entries = make(map[pushCacheKey]*pushCacheEntry)
+		c.pushes = make(map[*http.Request]*pushCacheEntry)
+	}
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultPushCacheTTL
+	}
+	entry := &pushCacheEntry{
+		key:      key,
+		response: res,
+		expires:  time.Now().Add(ttl),
+		done:     make(chan struct{}),
+	}
+	c.entries[key] = entry
+	c.pushes[req] = entry
+	c.order = append(c.order, entry)
+}
+
+// grow accounts for n more bytes being stored for entry,
+// discarding the oldest entries if necessary. It returns
+// false if entry has been discarded. c must be locked.
+func (c *PushCache) grow(entry *pushCacheEntry, n int64) bool {
+	if entry.taken {
+		// The push is already being used.
+		return true
+	}
+
+	max := c.MaxBytes
+	if max == 0 {
+		max = DefaultPushCacheSize
+	}
+	if entry.size+n > max {
+		c.remove(entry)
+		return false
+	}
+
+	entry.size += n
+	c.size += n
+	for c.size > max && len(c.order) > 0 && c.order[0] != entry {
+		c.remove(c.order[0])
+	}
+	return true
+}
+
+// expire discards any pushes which have expired.
+// c must be locked.
+func (c *PushCache) expire(now time.Time) {
+	for len(c.order) > 0 && now.After(c.order[0].expires) {
+		c.remove(c.order[0])
+	}
+	for req, entry := range c.pushes {
+		if now.After(entry.expires) {
+			delete(c.pushes, req)
+		}
+	}
+}
+
+// remove discards entry. c must be locked.
+func (c *PushCache) remove(entry *pushCacheEntry) {
+	for req, e := range c.pushes {
+		if e == entry {
+			delete(c.pushes, req)
+		}
+	}
+	c.take(entry)
+}
+
+// take removes entry from the cache so that it can be
+// used, while any remaining data is still received.
+// c must be locked.
+func (c *PushCache) take(entry *pushCacheEntry) {
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+	for i, e := range c.order {
+		if e == entry {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.size -= entry.size
+	entry.size = 0
+	entry.taken = true
+}
+
+// pushCacheReceiver is the Receiver used to store
+// the pushes received on a single connection.
+type pushCacheReceiver struct {
+	cache   *PushCache
+	origin  string
+	version float64
+	next    Receiver
+}
+
+func (r *pushCacheReceiver) ReceiveData(req *http.Request, data []byte, final bool) {
+	c := r.cache
+	c.mu.Lock()
+	if entry, ok := c.pushes[req]; ok && c.grow(entry, int64(len(data))) {
+		entry.response.ReceiveData(req, data, final)
+		if final {
+			entry.complete = true
+			delete(c.pushes, req)
+			close(entry.done)
+		}
+	}
+	c.mu.Unlock()
+
+	if r.next != nil {
+		r.next.ReceiveData(req, data, final)
+	}
+}
+
+func (r *pushCacheReceiver) ReceiveHeader(req *http.Request, header http.Header) {
+	c := r.cache
+	c.mu.Lock()
+	if entry, ok := c.pushes[req]; ok {
+		// Leave out the request line sent
+		// in the push's SYN_STREAM.
+		response := make(http.Header, len(header))
+		for name, values := range header {
+			switch http.CanonicalHeaderKey(name) {
+			case ":method", ":path", ":host", ":scheme", "Method", "Url", "Host", "Scheme":
+				continue
+			}
+			response[name] = values
+		}
+		entry.response.ReceiveHeader(req, response)
+	}
+	c.mu.Unlock()
+
+	if r.next != nil {
+		r.next.ReceiveHeader(req, header)
+	}
+}
+
+func (r *pushCacheReceiver) ReceiveRequest(req *http.Request) bool {
+	accept := false
+	if r.next != nil {
+		accept = r.next.ReceiveRequest(req)
+	}
+	if req.Method != "" && req.Method != "GET" {
+		return accept
+	}
+
+	res := &response{Data: new(bytes.Buffer), statusHeader: ":status", versionHeader: ":version"}
+	if r.version == 2 {
+		res.statusHeader, res.versionHeader = "status", "version"
+	}
+
+	key := pushCacheKey{origin: r.origin, url: pushCacheURL(req)}
+	c := r.cache
+	c.mu.Lock()
+	c.expire(time.Now())
+	c.add(key, req, res)
+	c.mu.Unlock()
+	return true
+}
+
+func (r *pushCacheReceiver) pushCancelled(req *http.Request) {
+	c := r.cache
+	c.mu.Lock()
+	if entry, ok := c.pushes[req]; ok {
+		c.remove(entry)
+		entry.cancelled = true
+		close(entry.done)
+	}
+	c.mu.Unlock()
+
+	pushCancelled(r.next, req)
+}
+
+// pushCacheURL returns the URL of a pushed request, with
+// the default port added to the host if necessary, as is
+// done by Transport.RoundTrip.
+func pushCacheURL(req *http.Request) string {
+	u := *req.URL
+	if !strings.Contains(u.Host, ":") {
+		switch u.Scheme {
+		case "http":
+			u.Host += ":80"
+		case "https":
+			u.Host += ":443"
+		}
+	}
+	return u.String()
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CancelPush cancels a server push which has been accepted
+// by a client, by sending RST_STREAM with status CANCEL. The
+// request must be the one passed to the PushReceiver. No
+// more of the push is passed to the PushReceiver.
+func CancelPush(req *http.Request) error {
+	info, ok := StreamInfoFromContext(req.Context())
+	if !ok || info.StreamID&1 != 0 {
+		return errors.New("Error: Request is not a server push.")
+	}
+
+	switch conn := info.Conn.(type) {
+	case *connV3:
+		return conn.cancelPush(info.StreamID)
+	case *connV2:
+		return conn.cancelPush(info.StreamID)
+	default:
+		return ErrNotSPDY
+	}
+}
+
+// pushCanceller is implemented by Receivers which
+// need to know when a push they have accepted is
+// cancelled, or reset by the server.
+type pushCanceller interface {
+	pushCancelled(req *http.Request)
+}
+
+// pushCancelled informs receiver that the push
+// for req has been cancelled, if it needs to know.
+func pushCancelled(receiver Receiver, req *http.Request) {
+	if c, ok := receiver.(pushCanceller); ok {
+		c.pushCancelled(req)
+	}
+}
+
+// pushFilter is a Receiver which cancels pushes with
+// unwanted Content-Types, or which are too large,
+// passing the rest on to the next Receiver.
+type pushFilter struct {
+	next         Receiver
+	contentTypes []string
+	maxSize      int64
+
+	mu       sync.Mutex
+	received map[*http.Request]int64
+}
+
+func newPushFilter(next Receiver, contentTypes []string, maxSize int64) *pushFilter {
+	return &pushFilter{
+		next:         next,
+		contentTypes: contentTypes,
+		maxSize:      maxSize,
+		received:     make(map[*http.Request]int64),
+	}
+}
+
+func (f *pushFilter) ReceiveData(req *http.Request, data []byte, final bool) {
+	f.mu.Lock()
+	received, ok := f.received[req]
+	received += int64(len(data))
+	if ok && !final {
+		f.received[req] = received
+	} else {
+		delete(f.received, req)
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if f.maxSize > 0 && received > f.maxSize {
+		f.reject(req)
+		return
+	}
+	f.next.ReceiveData(req, data, final)
+}
+
+func (f *pushFilter) ReceiveHeader(req *http.Request, header http.Header) {
+	f.mu.Lock()
+	_, ok := f.received[req]
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if !f.allowed(header) {
+		f.reject(req)
+		return
+	}
+	f.next.ReceiveHeader(req, header)
+}
+
+func (f *pushFilter) ReceiveRequest(req *http.Request) bool {
+	if !f.next.ReceiveRequest(req) {
+		return false
+	}
+	f.mu.Lock()
+	f.received[req] = 0
+	f.mu.Unlock()
+	return true
+}
+
+func (f *pushFilter) pushCancelled(req *http.Request) {
+	f.mu.Lock()
+	delete(f.received, req)
+	f.mu.Unlock()
+	pushCancelled(f.next, req)
+}
+
+// reject cancels the push for req.
+func (f *pushFilter) reject(req *http.Request) {
+	f.mu.Lock()
+	delete(f.received, req)
+	f.mu.Unlock()
+
+	if err := CancelPush(req); err != nil {
+		// The push has already finished, so
+		// just discard it.
+		pushCancelled(f.next, req)
+	}
+}
+
+// allowed indicates whether a push with the given
+// headers passes the filter.
+func (f *pushFilter) allowed(header http.Header) bool {
+	if f.maxSize > 0 {
+		if length := header.Get("Content-Length"); length != "" {
+			n, err := strconv.ParseInt(strings.TrimSpace(length), 10, 64)
+			if err != nil || n > f.maxSize {
+				return false
+			}
+		}
+	}
+
+	contentType := header.Get("Content-Type")
+	if len(f.contentTypes) == 0 || contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range f.contentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pushAuthorized indicates whether a push of the resource at u
+// may be associated with the request origin. The resource must
+// use the same scheme and port as the origin, and either the
+// same host, or a host covered by one of the certificates.
+func pushAuthorized(u *url.URL, origin *http.Request, secure bool, certs []*x509.Certificate) bool {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	if !strings.EqualFold(u.Scheme, scheme) {
+		return false
+	}
+
+	authority := origin.Host
+	if authority == "" && origin.URL != nil {
+		authority = origin.URL.Host
+	}
+	host, port := splitHostPort(u.Host, scheme)
+	originHost, originPort := splitHostPort(authority, scheme)
+	if host == "" || port != originPort {
+		return false
+	}
+	if strings.EqualFold(host, originHost) {
+		return true
+	}
+
+	// Other hosts must be covered by the certificate.
+	if !secure {
+		return false
+	}
+	for _, cert := range certs {
+		if cert.VerifyHostname(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHostPort splits an authority into its host
+// and port, using the scheme's default port if none
+// is given.
+func splitHostPort(authority, scheme string) (host, port string) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, ""
+	}
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port
+}
+
+// serverCertificates returns the parsed certificates
+// which srv presents to clients.
+func serverCertificates(srv *http.Server) []*x509.Certificate {
+	if srv == nil || srv.TLSConfig == nil {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for _, cert := range srv.TLSConfig.Certificates {
+		if cert.Leaf != nil {
+			certs = append(certs, cert.Leaf)
+			continue
+		}
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			certs = append(certs, leaf)
+		}
+	}
+	return certs
+}
+
+// peerCertificates returns the certificates presented
+// by the other endpoint of a TLS connection, if any.
+func peerCertificates(state *tls.ConnectionState) []*x509.Certificate {
+	if state == nil {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// streamRequest returns the request sent on a
+// server or client stream, or nil if it has none.
+func streamRequest(stream Stream) *http.Request {
+	switch stream := stream.(type) {
+	case *serverStreamV3:
+		return stream.request
+	case *serverStreamV2:
+		return stream.request
+	case *clientStreamV3:
+		return stream.request
+	case *clientStreamV2:
+		return stream.request
+	default:
+		return nil
+	}
+}
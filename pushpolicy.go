@@ -0,0 +1,349 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultPushPolicyPages is the number of pages, and of
+// resource sizes, a PushPolicy remembers if its MaxPages
+// is zero.
+const DefaultPushPolicyPages = 1000
+
+// PushPolicy learns which resources are fetched after each
+// page, and pushes the most likely of them when the page is
+// loaded again. It is registered with ServerConfig.
+//
+// A page is loaded by a navigation request, such as one with
+// "Sec-Fetch-Mode: navigate", or which accepts text/html. A
+// resource is taken to follow a page when it is requested on
+// the same connection as the page, with a Referer naming the
+// page. The confidence that a resource follows a page is the
+// fraction of the page's loads after which it was fetched.
+// Loads after which the resource was pushed are not counted,
+// as the client had no need to fetch it. Resources are pushed
+// in order of confidence, once the page has been loaded
+// MinLoads times.
+//
+// A PushPolicy may be shared between servers.
+type PushPolicy struct {
+	// Threshold is the confidence, between 0 and 1, which
+	// a resource must reach before it is pushed. If zero,
+	// 0.5 is used.
+	Threshold float64
+
+	// Budget, if non-zero, is the maximum number of bytes
+	// pushed for each page load, based on the size of each
+	// resource when it was last served.
+	Budget int64
+
+	// MinLoads is the number of times a page must be loaded
+	// before its resources are pushed. If zero, 2 is used.
+	MinLoads int
+
+	// MaxPages is the maximum number of pages, and of
+	// resource sizes, remembered. If zero,
+	// DefaultPushPolicyPages is used. Once the limit is
+	// reached, the least recently used are forgotten.
+	MaxPages int
+
+	mu    sync.Mutex
+	pages lru // of *pageHistory.
+	sizes lru // of int64.
+}
+
+// pageHistory records the resources fetched
+// after a page.
+type pageHistory struct {
+	loads     int
+	resources map[string]*resourceHistory
+}
+
+// resourceHistory records how often a resource
+// was fetched or pushed after a page.
+type resourceHistory struct {
+	fetches int
+	pushes  int
+}
+
+// confidence returns the fraction of the page's loads
+// after which resource was fetched, ignoring those after
+// which it was pushed.
+func (page *pageHistory) confidence(resource string) float64 {
+	r := page.resources[resource]
+	if r == nil || page.loads <= r.pushes {
+		return 0
+	}
+	return float64(r.fetches) / float64(page.loads-r.pushes)
+}
+
+// pushHistory records the pages and resources sent
+// on a single connection, for use with a PushPolicy.
+type pushHistory struct {
+	sync.Mutex
+	pages map[string]bool // pages loaded on the connection.
+	sent  map[string]bool // resources requested or pushed on the connection.
+}
+
+func newPushHistory() *pushHistory {
+	return &pushHistory{
+		pages: make(map[string]bool),
+		sent:  make(map[string]bool),
+	}
+}
+
+// Learned returns the dependencies learned so far. For
+// each page, it gives the confidence that each resource
+// will be fetched after the page is loaded.
+func (p *PushPolicy) Learned() map[string]map[string]float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make(map[string]map[string]float64, p.pages.len())
+	p.pages.each(func(target string, value interface{}) {
+		page := value.(*pageHistory)
+		if page.loads == 0 {
+			return
+		}
+		resources := make(map[string]float64, len(page.resources))
+		for resource := range page.resources {
+			resources[resource] = page.confidence(resource)
+		}
+		out[target] = resources
+	})
+	return out
+}
+
+// Reset discards the dependencies learned so far.
+func (p *PushPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pages = lru{}
+	p.sizes = lru{}
+}
+
+// observe records a request received on a connection with
+// the given history, learning from its Referer.
+func (p *PushPolicy) observe(history *pushHistory, request *http.Request) {
+	if request.Method != "GET" {
+		return
+	}
+	target := request.URL.RequestURI()
+	referer, hasReferer := "", false
+	if ref := request.Header.Get("Referer"); ref != "" {
+		referer, hasReferer = sameOrigin(ref, request)
+	}
+	navigation := isNavigation(request)
+
+	history.Lock()
+	fetched := history.sent[target]
+	followed := hasReferer && history.pages[referer] && !fetched
+	history.sent[target] = true
+	if navigation {
+		history.pages[target] = true
+	}
+	history.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if navigation {
+		p.page(target).loads++
+	}
+	if followed && referer != target {
+		p.page(referer).resource(target).fetches++
+	}
+}
+
+// observeSize records the size of a resource
+// which has been served.
+func (p *PushPolicy) observeSize(request *http.Request, size int64) {
+	if request.Method != "GET" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sizes.set(request.URL.RequestURI(), size, p.maxPages())
+}
+
+// pushes returns the resources which should be pushed in
+// response to request, on a connection with the given
+// history.
+func (p *PushPolicy) pushes(history *pushHistory, request *http.Request) []string {
+	if request.Method != "GET" || !isNavigation(request) {
+		return nil
+	}
+	target := request.URL.RequestURI()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	value, ok := p.pages.get(target)
+	if !ok {
+		return nil
+	}
+	page := value.(*pageHistory)
+	minLoads := p.MinLoads
+	if minLoads == 0 {
+		minLoads = 2
+	}
+	if page.loads < minLoads {
+		return nil
+	}
+	threshold := p.Threshold
+	if threshold == 0 {
+		threshold = 0.5
+	}
+
+	// Find the likely resources, most
+	// likely first.
+	var candidates []string
+	for resource := range page.resources {
+		if page.confidence(resource) >= threshold {
+			candidates = append(candidates, resource)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := page.confidence(candidates[i]), page.confidence(candidates[j])
+		if a != b {
+			return a > b
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	history.Lock()
+	defer history.Unlock()
+
+	var out []string
+	var total int64
+	for _, resource := range candidates {
+		if history.sent[resource] {
+			continue
+		}
+		if p.Budget > 0 {
+			var size int64
+			if value, ok := p.sizes.get(resource); ok {
+				size = value.(int64)
+			}
+			if total+size > p.Budget {
+				continue
+			}
+			total += size
+		}
+		out = append(out, resource)
+	}
+	return out
+}
+
+// pushed records that resource has been pushed in response
+// to request, on a connection with the given history. The
+// page load is not counted towards the resource's confidence.
+func (p *PushPolicy) pushed(history *pushHistory, request *http.Request, resource string) {
+	history.Lock()
+	history.sent[resource] = true
+	history.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.page(request.URL.RequestURI()).resource(resource).pushes++
+}
+
+// page returns the history for the given page,
+// creating it if necessary. p must be locked.
+func (p *PushPolicy) page(target string) *pageHistory {
+	if value, ok := p.pages.get(target); ok {
+		return value.(*pageHistory)
+	}
+	page := &pageHistory{resources: make(map[string]*resourceHistory)}
+	p.pages.set(target, page, p.maxPages())
+	return page
+}
+
+// resource returns the history for the given
+// resource, creating it if necessary.
+func (page *pageHistory) resource(target string) *resourceHistory {
+	r := page.resources[target]
+	if r == nil {
+		r = new(resourceHistory)
+		page.resources[target] = r
+	}
+	return r
+}
+
+func (p *PushPolicy) maxPages() int {
+	if p.MaxPages > 0 {
+		return p.MaxPages
+	}
+	return DefaultPushPolicyPages
+}
+
+// isNavigation indicates whether request loads
+// a page, rather than a resource used by one.
+func isNavigation(request *http.Request) bool {
+	if mode := request.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(request.Header.Get("Accept"), "text/html")
+}
+
+// lru is a map which forgets the least
+// recently used entries beyond a limit.
+type lru struct {
+	entries map[string]*list.Element
+	order   list.List // of *lruEntry, most recently used first.
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func (l *lru) len() int {
+	return len(l.entries)
+}
+
+// get returns the value for key, marking
+// it as the most recently used.
+func (l *lru) get(key string) (interface{}, bool) {
+	elt, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elt)
+	return elt.Value.(*lruEntry).value, true
+}
+
+// set stores the value for key, then forgets the least
+// recently used entries until at most limit remain.
+func (l *lru) set(key string, value interface{}, limit int) {
+	if elt, ok := l.entries[key]; ok {
+		elt.Value.(*lruEntry).value = value
+		l.order.MoveToFront(elt)
+		return
+	}
+	if l.entries == nil {
+		l.entries = make(map[string]*list.Element)
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value})
+	for len(l.entries) > limit {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// each calls f with each entry.
+func (l *lru) each(f func(key string, value interface{})) {
+	for elt := l.order.Front(); elt != nil; elt = elt.Next() {
+		entry := elt.Value.(*lruEntry)
+		f(entry.key, entry.value)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func navigation(t *testing.T, target string) *http.Request {
+	req, err := http.NewRequest("GET", "http://example.com"+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	return req
+}
+
+func subresource(t *testing.T, target, referer string) *http.Request {
+	req, err := http.NewRequest("GET", "http://example.com"+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Sec-Fetch-Mode", "no-cors")
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	return req
+}
+
+// load records a page being loaded on a new
+// connection, followed by its resources.
+func load(t *testing.T, p *PushPolicy, page string, resources ...string) {
+	history := newPushHistory()
+	p.observe(history, navigation(t, page))
+	for _, resource := range resources {
+		p.observe(history, subresource(t, resource, "http://example.com"+page))
+	}
+}
+
+func TestPushPolicyLearns(t *testing.T) {
+	p := new(PushPolicy)
+	load(t, p, "/", "/a.css", "/b.js")
+	load(t, p, "/", "/a.css")
+	load(t, p, "/")
+
+	// Resources without a Referer naming the
+	// page, or from another origin, are ignored.
+	history := newPushHistory()
+	p.observe(history, navigation(t, "/other"))
+	p.observe(history, subresource(t, "/c.js", ""))
+	p.observe(history, subresource(t, "/d.js", "http://example.org/other"))
+
+	want := map[string]map[string]float64{
+		"/":      {"/a.css": 2.0 / 3, "/b.js": 1.0 / 3},
+		"/other": {},
+	}
+	if got := p.Learned(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Learned %v, expected %v.", got, want)
+	}
+
+	p.Reset()
+	if got := p.Learned(); len(got) != 0 {
+		t.Fatalf("Learned %v after Reset, expected nothing.", got)
+	}
+}
+
+func TestPushPolicyThreshold(t *testing.T) {
+	tests := []struct {
+		threshold float64
+		minLoads  int
+		want      []string
+	}{
+		{0, 0, []string{"/a.css"}},
+		{0.3, 0, []string{"/a.css", "/b.js"}},
+		{0.9, 0, nil},
+		{0.3, 4, nil},
+	}
+
+	for _, test := range tests {
+		p := &PushPolicy{Threshold: test.threshold, MinLoads: test.minLoads}
+		load(t, p, "/", "/a.css", "/b.js")
+		load(t, p, "/", "/a.css")
+		load(t, p, "/")
+
+		got := p.pushes(newPushHistory(), navigation(t, "/"))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Threshold %v, MinLoads %d: pushed %q, expected %q.", test.threshold, test.minLoads, got, test.want)
+		}
+	}
+}
+
+func TestPushPolicyBudget(t *testing.T) {
+	p := &PushPolicy{Budget: 800}
+	for i := 0; i < 2; i++ {
+		load(t, p, "/", "/a.css", "/b.js", "/c.js")
+	}
+	p.observeSize(subresource(t, "/a.css", ""), 600)
+	p.observeSize(subresource(t, "/b.js", ""), 300)
+	p.observeSize(subresource(t, "/c.js", ""), 200)
+
+	// /b.js would exceed the budget,
+	// but /c.js still fits.
+	want := []string{"/a.css", "/c.js"}
+	if got := p.pushes(newPushHistory(), navigation(t, "/")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Pushed %q, expected %q.", got, want)
+	}
+
+	// Resources already sent on the connection
+	// are not pushed, or counted.
+	history := newPushHistory()
+	p.observe(history, subresource(t, "/a.css", ""))
+	want = []string{"/b.js", "/c.js"}
+	if got := p.pushes(history, navigation(t, "/")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Pushed %q after /a.css was fetched, expected %q.", got, want)
+	}
+}
+
+func TestPushPolicyEviction(t *testing.T) {
+	p := &PushPolicy{MaxPages: 2}
+	load(t, p, "/one", "/one.css")
+	load(t, p, "/two", "/two.css")
+	load(t, p, "/one", "/one.css")
+	load(t, p, "/three", "/three.css")
+
+	// /two was the least recently used.
+	learned := p.Learned()
+	if len(learned) != 2 || learned["/one"] == nil || learned["/three"] == nil {
+		t.Fatalf("Learned %v, expected /one and /three.", learned)
+	}
+
+	p.observeSize(subresource(t, "/one.css", ""), 1)
+	p.observeSize(subresource(t, "/two.css", ""), 2)
+	p.observeSize(subresource(t, "/three.css", ""), 3)
+	if _, ok := p.sizes.get("/one.css"); ok {
+		t.Fatal("Size of /one.css was not forgotten.")
+	}
+	if p.sizes.len() != 2 {
+		t.Fatalf("Remembered %d sizes, expected 2.", p.sizes.len())
+	}
+}
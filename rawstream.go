@@ -0,0 +1,59 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"net"
+	"net/http"
+)
+
+// RawStream is a stream which carries raw bytes, rather than
+// an HTTP request and response, so that a SPDY connection can
+// be used to multiplex other protocols. It is opened with the
+// Conn's OpenStream method, and the other endpoint receives it
+// with Accept, once it has enabled raw streams with
+// SetRawStreams. Accept answers the stream with SYN_REPLY.
+// Either endpoint may open raw streams.
+//
+// A RawStream is a net.Conn. Each direction is finished
+// independently, with CloseWrite sending FIN, after which
+// Read returns io.EOF once the other endpoint has done the
+// same. Close cancels the stream with RST_STREAM, unless
+// both directions have already finished, so any unsent data
+// is discarded.
+//
+// Writes are subject to the stream's flow control, and only
+// return once the transfer window has allowed any previous
+// data to be sent. The window is only regrown as data is
+// read, so a slow reader slows the writer.
+type RawStream interface {
+	Stream
+	net.Conn
+
+	// CloseWrite sends FIN, once any data held back
+	// by flow control has been sent. Data can still
+	// be read until the other endpoint sends FIN.
+	CloseWrite() error
+
+	// ReceivedHeader returns the headers sent by the
+	// other endpoint, starting with those sent when
+	// the stream was opened or accepted. Headers are
+	// sent with the next Write or CloseWrite after they
+	// are added to the stream's Header.
+	ReceivedHeader() http.Header
+}
+
+// rawStreamBacklog is the number of raw streams opened
+// by the other endpoint which are held until Accept is
+// called. Further streams are refused with
+// RST_STREAM_REFUSED_STREAM.
+const rawStreamBacklog = 16
+
+// isRawStream indicates whether a SYN_STREAM opens a raw
+// stream, rather than carrying a request or server push.
+// Raw streams have no HTTP method or associated stream.
+func isRawStream(frame *synStreamFrameV3) bool {
+	return frame.AssocStreamID == 0 && frame.Header.Get(":method") == ""
+}
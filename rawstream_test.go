@@ -0,0 +1,83 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestAcceptReplies checks that accepting a raw stream
+// answers it with SYN_REPLY, even if nothing is written.
+func TestAcceptReplies(t *testing.T) {
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	defer ReleaseServer(srv)
+
+	client, server := net.Pipe()
+	conn, err := NewServerConn(server, srv, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetRawStreams(true)
+	done := make(chan struct{})
+	go func() {
+		conn.Run()
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		conn.Close()
+		<-done
+	}()
+
+	com := NewCompressor(3)
+	defer com.Close()
+	syn := &synStreamFrameV3{StreamID: 1, Header: http.Header{"Test": {"raw"}}}
+	if err := syn.Compress(com); err != nil {
+		t.Fatal(err)
+	}
+	go syn.WriteTo(client)
+
+	accepted := make(chan RawStream, 1)
+	go func() {
+		stream, err := conn.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- stream
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := bufio.NewReader(client)
+	decom := NewDecompressor(3)
+	for {
+		frame, err := readFrameV3(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *synReplyFrameV3:
+			if frame.StreamID != 1 {
+				t.Fatalf("Received SYN_REPLY for stream %d, expected 1.", frame.StreamID)
+			}
+			if frame.Flags.FIN() {
+				t.Fatal("Received SYN_REPLY with FIN.")
+			}
+			stream := <-accepted
+			if got := stream.ReceivedHeader().Get("Test"); got != "raw" {
+				t.Fatalf("Accepted stream with header %q, expected %q.", got, "raw")
+			}
+			return
+		case *headersFrameV3, *dataFrameV3, *rstStreamFrameV3:
+			t.Fatalf("Received %s before SYN_REPLY.", frame.Name())
+		}
+	}
+}
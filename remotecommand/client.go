@@ -0,0 +1,177 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remotecommand
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// Options describes how a remote command's
+// input and output are connected.
+type Options struct {
+	// Stdin, if non-nil, is sent to the command's
+	// standard input. The command's standard input
+	// is closed once Stdin returns io.EOF.
+	Stdin io.Reader
+
+	// Stdout and Stderr, if non-nil, receive the
+	// command's standard output and error.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// TTY indicates that the command should be run
+	// in a terminal. In this case, its standard
+	// error is sent to Stdout, and Stderr is unused.
+	TTY bool
+
+	// Resize, if non-nil, gives the terminal size
+	// whenever it changes. It should be closed once
+	// the command has finished.
+	Resize <-chan TerminalSize
+}
+
+// Run runs the command on the other endpoint of conn, which
+// must be served by a Handler. Run returns once the command
+// has exited, and its output has been written. If the command
+// exits with a non-zero status, the error is an *ExitError.
+//
+// As with os/exec, if Stdin is not an *os.File, Run does not
+// wait for it to be read to the end, so a goroutine reading
+// from it may remain.
+func Run(conn spdy.Conn, command []string, options *Options) error {
+	if len(command) == 0 {
+		return errors.New("Error: No command given.")
+	}
+	if options == nil {
+		options = new(Options)
+	}
+
+	var types []string
+	if options.Stdin != nil {
+		types = append(types, StreamTypeStdin)
+	}
+	if options.Stdout != nil {
+		types = append(types, StreamTypeStdout)
+	}
+	if options.Stderr != nil && !options.TTY {
+		types = append(types, StreamTypeStderr)
+	}
+	if options.Resize != nil {
+		types = append(types, StreamTypeResize)
+	}
+
+	// Open the error stream, which carries
+	// the command.
+	header := make(http.Header)
+	header.Set(StreamTypeHeader, StreamTypeError)
+	header[CommandHeader] = command
+	header.Set(TTYHeader, strconv.FormatBool(options.TTY))
+	header.Set(StreamsHeader, strings.Join(types, ","))
+	errStream, err := conn.OpenStream(header, 0)
+	if err != nil {
+		return err
+	}
+	defer errStream.Close()
+	errStream.CloseWrite()
+
+	// Open the other streams.
+	id := strconv.FormatUint(uint64(errStream.StreamID()), 10)
+	streams := make(map[string]spdy.RawStream)
+	for _, streamType := range types {
+		header := make(http.Header)
+		header.Set(StreamTypeHeader, streamType)
+		header.Set(RequestIDHeader, id)
+		priority := spdy.Priority(4)
+		if streamType == StreamTypeResize {
+			priority = 0
+		}
+		stream, err := conn.OpenStream(header, priority)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		streams[streamType] = stream
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if stream := streams[StreamTypeStdin]; stream != nil {
+		go func() {
+			io.Copy(stream, options.Stdin)
+			stream.CloseWrite()
+		}()
+	}
+
+	if stream := streams[StreamTypeResize]; stream != nil {
+		go sendResizes(stream, options.Resize, done)
+	}
+
+	// Copy the output until the server
+	// has finished each stream.
+	var wg sync.WaitGroup
+	copyOutput := func(stream spdy.RawStream, w io.Writer) {
+		stream.CloseWrite()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(w, stream)
+		}()
+	}
+	if stream := streams[StreamTypeStdout]; stream != nil {
+		copyOutput(stream, options.Stdout)
+	}
+	if stream := streams[StreamTypeStderr]; stream != nil {
+		copyOutput(stream, options.Stderr)
+	}
+
+	// Wait for the exit status.
+	message, err := io.ReadAll(errStream)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if len(message) > 0 {
+		return errors.New(string(message))
+	}
+
+	status := errStream.ReceivedHeader().Get(ExitCodeHeader)
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return errors.New("Error: Invalid exit code " + strconv.Quote(status) + ".")
+	}
+	if code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
+
+// sendResizes sends each terminal size to the server,
+// until sizes is closed or done is closed.
+func sendResizes(stream spdy.RawStream, sizes <-chan TerminalSize, done <-chan struct{}) {
+	encoder := json.NewEncoder(stream)
+	for {
+		select {
+		case size, ok := <-sizes:
+			if !ok {
+				stream.CloseWrite()
+				return
+			}
+			if err := encoder.Encode(size); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package remotecommand runs commands on the other endpoint of
+// a SPDY connection, with separate streams for the command's
+// standard input, output and error, its exit status, and any
+// terminal resize events.
+//
+// The client calls Run, which wires the given readers and
+// writers to the remote process. The server calls a Handler's
+// Serve method on the connection, which spawns a local process
+// for each command received.
+//
+// Each command uses a set of raw streams, opened by the client
+// with spdy.Conn's OpenStream, and identified by their
+// Stream-Type header. The error stream is opened first, and
+// carries the command and options in its headers, along with
+// the types of the other streams in use. Each of the others
+// carries the error stream's ID in its Request-Id header.
+//
+// Once the process has exited, the server sends its exit code
+// in the Exit-Code header of the error stream, then finishes
+// the stream. If the process could not be run, the reason is
+// sent as the error stream's data instead. Each stream is
+// half-closed by the side which does not write to it as soon
+// as it is opened, and by the other side once its data has
+// been sent, so closing the client's standard input closes the
+// process's.
+//
+// Terminal resize events are sent on the resize stream as a
+// series of JSON-encoded TerminalSize values.
+//
+// Raw streams require SPDY/3 or later, and must be enabled on
+// the server's connection with SetRawStreams.
+package remotecommand
+
+import (
+	"fmt"
+)
+
+// Headers used to describe the streams of a command.
+const (
+	StreamTypeHeader = "Stream-Type" // The stream's type, such as StreamTypeStdin.
+	RequestIDHeader  = "Request-Id"  // The ID of the command's error stream.
+	CommandHeader    = "Command"     // The command and its arguments, one per value.
+	TTYHeader        = "Tty"         // "true" if the command uses a terminal.
+	StreamsHeader    = "Streams"     // The types of the command's other streams.
+	ExitCodeHeader   = "Exit-Code"   // The command's exit code.
+)
+
+// Stream types.
+const (
+	StreamTypeError  = "error"
+	StreamTypeStdin  = "stdin"
+	StreamTypeStdout = "stdout"
+	StreamTypeStderr = "stderr"
+	StreamTypeResize = "resize"
+)
+
+// TerminalSize is the size of a terminal,
+// in characters.
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// ExitError is returned by Run when the remote
+// command exits with a non-zero status. Code is
+// -1 if the process was ended by a signal.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Error: Command exited with status %d.", e.Code)
+}
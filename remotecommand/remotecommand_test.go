@@ -0,0 +1,197 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remotecommand
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// serve connects a client to a server over net.Pipe,
+// with the server's commands run by h. It returns the
+// client's connection.
+func serve(t *testing.T, h *Handler) spdy.Conn {
+	a, b := net.Pipe()
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	server, err := spdy.NewServerConn(a, srv, 3.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetRawStreams(true)
+	go server.Run()
+	go h.Serve(server)
+
+	client, err := spdy.NewClientConn(b, nil, 3.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		spdy.ReleaseServer(srv)
+	})
+	return client
+}
+
+func allowAll(command []string, tty bool) error {
+	return nil
+}
+
+// run calls Run, failing the test if it
+// does not return in time.
+func run(t *testing.T, conn spdy.Conn, command []string, options *Options) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(conn, command, options)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Command %q did not finish.", command)
+		return nil
+	}
+}
+
+func TestOutput(t *testing.T) {
+	conn := serve(t, &Handler{Allow: allowAll})
+
+	var stdout, stderr bytes.Buffer
+	options := &Options{Stdout: &stdout, Stderr: &stderr}
+	if err := run(t, conn, []string{"sh", "-c", "echo out; echo err >&2"}, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "out\n" {
+		t.Errorf("Received standard output %q, expected %q.", got, "out\n")
+	}
+	if got := stderr.String(); got != "err\n" {
+		t.Errorf("Received standard error %q, expected %q.", got, "err\n")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	conn := serve(t, &Handler{Allow: allowAll})
+
+	err := run(t, conn, []string{"sh", "-c", "exit 3"}, nil)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Received error %v, expected *ExitError.", err)
+	}
+	if exitErr.Code != 3 {
+		t.Fatalf("Received exit code %d, expected 3.", exitErr.Code)
+	}
+}
+
+// TestStdin checks that closing the client's standard
+// input closes the command's, so cat exits.
+func TestStdin(t *testing.T) {
+	conn := serve(t, &Handler{Allow: allowAll})
+
+	input := "hello\nworld\n"
+	var stdout bytes.Buffer
+	options := &Options{Stdin: strings.NewReader(input), Stdout: &stdout}
+	if err := run(t, conn, []string{"cat"}, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != input {
+		t.Fatalf("Received standard output %q, expected %q.", got, input)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	conn := serve(t, &Handler{Allow: func(command []string, tty bool) error {
+		return errors.New("Error: Denied.")
+	}})
+
+	err := run(t, conn, []string{"true"}, nil)
+	if err == nil || err.Error() != "Error: Denied." {
+		t.Fatalf("Received error %v, expected %q.", err, "Error: Denied.")
+	}
+}
+
+func TestNoAllow(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	defer spdy.ReleaseServer(srv)
+	conn, err := spdy.NewServerConn(a, srv, 3.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := new(Handler).Serve(conn); err != ErrNoAllow {
+		t.Fatalf("Received error %v, expected ErrNoAllow.", err)
+	}
+}
+
+// openPending starts a command whose standard
+// input stream is never opened.
+func openPending(t *testing.T, conn spdy.Conn) spdy.RawStream {
+	header := make(http.Header)
+	header.Set(StreamTypeHeader, StreamTypeError)
+	header[CommandHeader] = []string{"true"}
+	header.Set(StreamsHeader, StreamTypeStdin)
+	stream, err := conn.OpenStream(header, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseWrite()
+	return stream
+}
+
+// readMessage reads the error
+// sent on an error stream.
+func readMessage(t *testing.T, stream spdy.RawStream) string {
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(message)
+}
+
+func TestMaxPending(t *testing.T) {
+	conn := serve(t, &Handler{Allow: allowAll, MaxPending: 1})
+
+	first := openPending(t, conn)
+	defer first.Close()
+	second := openPending(t, conn)
+	defer second.Close()
+
+	want := "Error: Too many commands are being started."
+	if got := readMessage(t, second); got != want {
+		t.Fatalf("Received %q, expected %q.", got, want)
+	}
+}
+
+func TestPendingTimeout(t *testing.T) {
+	conn := serve(t, &Handler{Allow: allowAll, MaxPending: 1, PendingTimeout: 100 * time.Millisecond})
+
+	stream := openPending(t, conn)
+	defer stream.Close()
+
+	want := "Error: Timed out waiting for the command's streams."
+	if got := readMessage(t, stream); got != want {
+		t.Fatalf("Received %q, expected %q.", got, want)
+	}
+
+	// The command no longer counts
+	// towards MaxPending.
+	if err := run(t, conn, []string{"true"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remotecommand
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// Defaults used by a Handler whose
+// fields are zero.
+const (
+	DefaultMaxPending     = 16
+	DefaultPendingTimeout = 10 * time.Second
+)
+
+// ErrNoAllow is returned by Serve if the
+// Handler's Allow func is nil.
+var ErrNoAllow = errors.New("Error: Handler.Allow must be set before commands can be served.")
+
+// Handler runs the commands received on a connection
+// as local processes.
+type Handler struct {
+	// Allow is called with each command before it is
+	// run. If it returns an error, the command is
+	// refused, and the error is returned to the client.
+	// Allow must be set, or Serve fails with ErrNoAllow.
+	Allow func(command []string, tty bool) error
+
+	// Dir and Env are used for each process, as
+	// with exec.Cmd.
+	Dir string
+	Env []string
+
+	// Resize, if non-nil, is called with each terminal
+	// size sent by the client. As the standard library
+	// cannot create terminals, commands run with TTY
+	// are given pipes, with standard error sent to
+	// standard output. Resize can be used with a Cmd
+	// whose terminal is set up elsewhere.
+	Resize func(cmd *exec.Cmd, size TerminalSize)
+
+	// MaxPending is the maximum number of commands
+	// whose streams are still being opened. Further
+	// commands are refused. If zero, DefaultMaxPending
+	// is used.
+	MaxPending int
+
+	// PendingTimeout is the time allowed for all of a
+	// command's streams to be opened, after which the
+	// command is refused. If zero, DefaultPendingTimeout
+	// is used.
+	PendingTimeout time.Duration
+}
+
+// Serve accepts commands on conn, running each in a new
+// goroutine, until the connection is closed. Streams which
+// are not part of a command are reset.
+//
+// Serve enables raw streams on conn. To be sure that no
+// commands are refused, this should also be done with
+// SetRawStreams before the connection is started.
+func (h *Handler) Serve(conn spdy.Conn) error {
+	if h.Allow == nil {
+		return ErrNoAllow
+	}
+	conn.SetRawStreams(true)
+
+	var mu sync.Mutex
+	pending := make(map[string]*session)
+	defer func() {
+		mu.Lock()
+		for _, s := range pending {
+			s.timer.Stop()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		stream, err := conn.Accept()
+		if err == spdy.ErrConnClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		header := stream.ReceivedHeader()
+		streamType := header.Get(StreamTypeHeader)
+		var id string
+		if streamType == StreamTypeError {
+			id = strconv.FormatUint(uint64(stream.StreamID()), 10)
+			s := newSession(stream)
+			mu.Lock()
+			full := len(pending) >= h.maxPending()
+			if !full {
+				pending[id] = s
+				s.timer = time.AfterFunc(h.pendingTimeout(), func() {
+					mu.Lock()
+					expired := pending[id] == s
+					if expired {
+						delete(pending, id)
+					}
+					mu.Unlock()
+					if expired {
+						s.finish(0, errors.New("Error: Timed out waiting for the command's streams."))
+					}
+				})
+			}
+			mu.Unlock()
+			if full {
+				go s.finish(0, errors.New("Error: Too many commands are being started."))
+				continue
+			}
+		} else {
+			id = header.Get(RequestIDHeader)
+		}
+
+		mu.Lock()
+		s := pending[id]
+		added := s != nil && s.add(streamType, stream)
+		ready := added && s.ready()
+		if ready {
+			delete(pending, id)
+			s.timer.Stop()
+		}
+		mu.Unlock()
+
+		if !added {
+			stream.Close()
+			continue
+		}
+		if ready {
+			go h.run(s)
+		}
+	}
+}
+
+func (h *Handler) maxPending() int {
+	if h.MaxPending > 0 {
+		return h.MaxPending
+	}
+	return DefaultMaxPending
+}
+
+func (h *Handler) pendingTimeout() time.Duration {
+	if h.PendingTimeout > 0 {
+		return h.PendingTimeout
+	}
+	return DefaultPendingTimeout
+}
+
+// session holds the streams of a single command.
+type session struct {
+	command  []string
+	tty      bool
+	expected map[string]bool // types of the streams still to be opened.
+	errors   spdy.RawStream
+	stdin    spdy.RawStream
+	stdout   spdy.RawStream
+	stderr   spdy.RawStream
+	resize   spdy.RawStream
+	timer    *time.Timer // refuses the command if its streams are not opened in time.
+}
+
+func newSession(errStream spdy.RawStream) *session {
+	header := errStream.ReceivedHeader()
+	s := new(session)
+	s.command = header[CommandHeader]
+	s.tty = header.Get(TTYHeader) == "true"
+	s.errors = errStream
+	s.expected = make(map[string]bool)
+	for _, streamType := range strings.Split(header.Get(StreamsHeader), ",") {
+		if streamType != "" {
+			s.expected[streamType] = true
+		}
+	}
+	return s
+}
+
+// add stores a stream of the given type, returning
+// false if it was not expected.
+func (s *session) add(streamType string, stream spdy.RawStream) bool {
+	if streamType == StreamTypeError {
+		return true
+	}
+	if !s.expected[streamType] {
+		return false
+	}
+	delete(s.expected, streamType)
+
+	switch streamType {
+	case StreamTypeStdin:
+		s.stdin = stream
+	case StreamTypeStdout:
+		s.stdout = stream
+	case StreamTypeStderr:
+		s.stderr = stream
+	case StreamTypeResize:
+		s.resize = stream
+	default:
+		return false
+	}
+	return true
+}
+
+// ready indicates whether all of
+// the streams have been opened.
+func (s *session) ready() bool {
+	return len(s.expected) == 0
+}
+
+// streams returns the session's streams.
+func (s *session) streams() []spdy.RawStream {
+	var out []spdy.RawStream
+	for _, stream := range []spdy.RawStream{s.errors, s.stdin, s.stdout, s.stderr, s.resize} {
+		if stream != nil {
+			out = append(out, stream)
+		}
+	}
+	return out
+}
+
+// finish reports the outcome of the command, then
+// closes the streams. If err is non-nil, it is sent
+// as the reason the command failed. Otherwise, the
+// exit code is sent.
+func (s *session) finish(code int, err error) {
+	for _, stream := range []spdy.RawStream{s.stdout, s.stderr} {
+		if stream != nil {
+			stream.CloseWrite()
+		}
+	}
+	if err != nil {
+		io.WriteString(s.errors, err.Error())
+	} else {
+		s.errors.Header().Set(ExitCodeHeader, strconv.Itoa(code))
+	}
+	s.errors.CloseWrite()
+
+	for _, stream := range s.streams() {
+		stream.Close()
+	}
+}
+
+// run runs a command, once its streams have been opened.
+func (h *Handler) run(s *session) {
+	// The client writes to these streams.
+	for _, stream := range []spdy.RawStream{s.stdin, s.resize} {
+		if stream != nil {
+			stream.CloseWrite()
+		}
+	}
+
+	if len(s.command) == 0 {
+		s.finish(0, errors.New("Error: No command given."))
+		return
+	}
+	if err := h.Allow(s.command, s.tty); err != nil {
+		s.finish(0, err)
+		return
+	}
+
+	cmd := exec.Command(s.command[0], s.command[1:]...)
+	cmd.Dir = h.Dir
+	cmd.Env = h.Env
+	if s.stdout != nil {
+		cmd.Stdout = s.stdout
+		if s.tty {
+			cmd.Stderr = s.stdout
+		}
+	}
+	if s.stderr != nil {
+		cmd.Stderr = s.stderr
+	}
+
+	// The standard input is copied separately, as
+	// exec.Cmd's Wait would wait for the client to
+	// close it.
+	var stdin io.WriteCloser
+	if s.stdin != nil {
+		var err error
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			s.finish(0, err)
+			return
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		s.finish(0, err)
+		return
+	}
+
+	if stdin != nil {
+		go func() {
+			io.Copy(stdin, s.stdin)
+			stdin.Close()
+		}()
+	}
+	if s.resize != nil {
+		go h.resizes(cmd, s.resize)
+	}
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		s.finish(0, nil)
+	case errors.As(err, &exitErr):
+		s.finish(exitErr.ExitCode(), nil)
+	default:
+		s.finish(0, err)
+	}
+}
+
+// resizes passes each terminal size sent
+// by the client to the Resize func.
+func (h *Handler) resizes(cmd *exec.Cmd, stream spdy.RawStream) {
+	decoder := json.NewDecoder(stream)
+	for {
+		var size TerminalSize
+		if err := decoder.Decode(&size); err != nil {
+			return
+		}
+		if h.Resize != nil {
+			h.Resize(cmd, size)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// requestHeaders gives the names of the headers which carry
+// the request line in a SYN_STREAM, for each SPDY version.
+// In SPDY/2, the Host header is used for the host.
+type requestHeaders struct {
+	method, path, version, host, scheme string
+}
+
+var requestHeadersV3 = requestHeaders{
+	method:  ":method",
+	path:    ":path",
+	version: ":version",
+	host:    ":host",
+	scheme:  ":scheme",
+}
+
+var requestHeadersV2 = requestHeaders{
+	method:  "method",
+	path:    "url",
+	version: "version",
+	host:    "host",
+	scheme:  "scheme",
+}
+
+// newServerRequest translates the header block of a received
+// SYN_STREAM into an http.Request, as net/http would have
+// parsed the equivalent HTTP/1.1 request. The headers naming
+// the request line are removed from the request's Header. If
+// fin is set, the request has no body. An error is returned
+// if any of the required headers are missing or invalid.
+func newServerRequest(header http.Header, names requestHeaders, fin bool) (*http.Request, error) {
+	get := func(name string) (string, error) {
+		value := header.Get(name)
+		if value == "" {
+			return "", fmt.Errorf("Error: Received SYN_STREAM without %q header.", name)
+		}
+		return value, nil
+	}
+
+	method, err := get(names.method)
+	if err != nil {
+		return nil, err
+	}
+	if strings.IndexFunc(method, isNotToken) >= 0 {
+		return nil, fmt.Errorf("Error: Received SYN_STREAM with invalid method %q.", method)
+	}
+
+	requestURI, err := get(names.path)
+	if err != nil {
+		return nil, err
+	}
+
+	vers, err := get(names.version)
+	if err != nil {
+		return nil, err
+	}
+	major, minor, ok := http.ParseHTTPVersion(vers)
+	if !ok {
+		return nil, fmt.Errorf("Error: Received SYN_STREAM with invalid HTTP version %q.", vers)
+	}
+
+	if _, err := get(names.scheme); err != nil {
+		return nil, err
+	}
+
+	host, err := get(names.host)
+	if err != nil {
+		return nil, err
+	}
+
+	rawurl := requestURI
+	if method == "CONNECT" && !strings.HasPrefix(rawurl, "/") {
+		rawurl = "http://" + rawurl
+	}
+	u, err := url.ParseRequestURI(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Received SYN_STREAM with invalid request URL: %v", err)
+	}
+	if method == "CONNECT" {
+		u.Scheme = ""
+	}
+
+	// Remove the request line and hop-by-hop headers.
+	header.Del(names.method)
+	header.Del(names.path)
+	header.Del(names.version)
+	header.Del(names.host)
+	header.Del(names.scheme)
+	header.Del("Host")
+	header.Del("Connection")
+	header.Del("Keep-Alive")
+	header.Del("Transfer-Encoding")
+
+	request := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      vers,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     header,
+		Host:       host,
+		RequestURI: requestURI,
+	}
+
+	// Determine the length of the body.
+	switch {
+	case fin:
+		request.ContentLength = 0
+		request.Body = http.NoBody
+	case header.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.New("Error: Received SYN_STREAM with invalid Content-Length.")
+		}
+		request.ContentLength = n
+	default:
+		request.ContentLength = -1
+	}
+
+	return request, nil
+}
+
+// serverContext returns the base context for requests
+// received on the given connection, containing the same
+// values as those used by net/http.
+func serverContext(srv *http.Server, conn net.Conn) context.Context {
+	ctx := context.WithValue(context.Background(), http.ServerContextKey, srv)
+	if conn != nil {
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, conn.LocalAddr())
+	}
+	return ctx
+}
+
+// isNotToken indicates whether r is not valid
+// in an HTTP token, such as a method.
+func isNotToken(r rune) bool {
+	if r <= ' ' || r >= 0x7f {
+		return true
+	}
+	return strings.ContainsRune("()<>@,;:\\\"/[]?={}", r)
+}
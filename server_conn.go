@@ -5,7 +5,7 @@
 package spdy
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -34,7 +34,7 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = server
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.buf, out.counter = newFrameReader(conn)
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -49,7 +49,8 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
-		out.pings = make(map[uint32]chan<- Ping)
+		out.pings = make(map[uint32]chan time.Duration)
+		out.pingSent = make(map[uint32]time.Time)
 		out.nextPingID = 2
 		out.compressor = NewCompressor(3)
 		out.decompressor = NewDecompressor(3)
@@ -66,6 +67,7 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 			out.certificates[1] = out.tlsState.PeerCertificates
 		}
 		out.stop = make(chan bool)
+		out.accepted = make(chan *rawStreamV3, rawStreamBacklog)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV3)
@@ -80,6 +82,9 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		}
 		out.flowControl = DefaultFlowControl(DEFAULT_INITIAL_WINDOW_SIZE)
 		out.pushedResources = make(map[Stream]map[string]struct{})
+		out.stats = newConnStats(statsForServer(server))
+		out.priorities = make(map[StreamID]Priority)
+		out.configure(server)
 
 		return out, nil
 
@@ -89,7 +94,7 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = server
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.buf, out.counter = newFrameReader(conn)
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -104,7 +109,8 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
-		out.pings = make(map[uint32]chan<- Ping)
+		out.pings = make(map[uint32]chan time.Duration)
+		out.pingSent = make(map[uint32]time.Time)
 		out.nextPingID = 2
 		out.compressor = NewCompressor(3)
 		out.decompressor = NewDecompressor(3)
@@ -114,10 +120,12 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.oddity = 0
 		out.initialWindowSize = DEFAULT_INITIAL_WINDOW_SIZE
 		out.connectionWindowSize = DEFAULT_INITIAL_WINDOW_SIZE
+		out.windowGrown = make(chan struct{}, 1)
 		out.requestStreamLimit = newStreamLimit(DEFAULT_STREAM_LIMIT)
 		out.pushStreamLimit = newStreamLimit(NO_STREAM_LIMIT)
 		out.vectorIndex = 8
 		out.stop = make(chan bool)
+		out.accepted = make(chan *rawStreamV3, rawStreamBacklog)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV3)
@@ -132,6 +140,9 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		}
 		out.flowControl = DefaultFlowControl(DEFAULT_INITIAL_WINDOW_SIZE)
 		out.pushedResources = make(map[Stream]map[string]struct{})
+		out.stats = newConnStats(statsForServer(server))
+		out.priorities = make(map[StreamID]Priority)
+		out.configure(server)
 		out.initialWindowSizeThere = out.flowControl.InitialWindowSize()
 		out.connectionWindowSizeThere = int64(out.initialWindowSizeThere)
 
@@ -142,7 +153,7 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = server
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.buf, out.counter = newFrameReader(conn)
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -157,7 +168,8 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
-		out.pings = make(map[uint32]chan<- Ping)
+		out.pings = make(map[uint32]chan time.Duration)
+		out.pingSent = make(map[uint32]time.Time)
 		out.nextPingID = 2
 		out.compressor = NewCompressor(2)
 		out.decompressor = NewDecompressor(2)
@@ -182,6 +194,8 @@ func NewServerConn(conn net.Conn, server *http.Server, version float64) (spdyCon
 			out.SetWriteTimeout(d)
 		}
 		out.pushedResources = make(map[Stream]map[string]struct{})
+		out.stats = newConnStats(statsForServer(server))
+		out.configure(server)
 
 		return out, nil
 
@@ -305,13 +319,76 @@ var ErrNotConnected = errors.New("Error: Not connected to given server.")
 //              }
 //      }
 func GetPriority(w http.ResponseWriter) (int, error) {
-	if stream, ok := w.(*serverStreamV3); ok {
-		return int(stream.priority), nil
+	stream, ok := streamFrom(w)
+	if !ok {
+		return 0, ErrNotSPDY
 	}
-	if stream, ok := w.(*serverStreamV2); ok {
-		return int(stream.priority), nil
+	return int(stream.Priority()), nil
+}
+
+// SetPriority is used to change the priority of the given
+// stream while it is open, such as to demote a background
+// download. The new priority applies to the frames the
+// stream sends from then on, including, with SPDY/3 and
+// later, any data held back by flow control.
+// If the underlying connection is using HTTP, and not SPDY,
+// SetPriority will return the ErrNotSPDY error.
+//
+// A simple example of lowering a stream's priority is:
+//
+//      import (
+//              "github.com/SlyMarbo/spdy"
+//              "net/http"
+//      )
+//
+//      func httpHandler(w http.ResponseWriter, r *http.Request) {
+//              err := spdy.SetPriority(w, 7)
+//              if err != nil {
+//                      // Non-SPDY connection, or invalid priority.
+//              }
+//
+//              // ...
+//      }
+func SetPriority(w http.ResponseWriter, priority Priority) error {
+	if stream, ok := streamFrom(w); ok {
+		return stream.SetPriority(priority)
 	}
-	return 0, ErrNotSPDY
+	return ErrNotSPDY
+}
+
+// ResetStream is used to abort the given stream early by
+// sending RST_STREAM with the given status, such as
+// RST_STREAM_CANCEL, RST_STREAM_REFUSED_STREAM or
+// RST_STREAM_INTERNAL_ERROR. The stream is then closed, and
+// any later writes to w will fail. The client receives a
+// *StreamError with the same status.
+// If the underlying connection is using HTTP, and not SPDY,
+// ResetStream will return the ErrNotSPDY error.
+//
+// A simple example of refusing a request is:
+//
+//      import (
+//              "github.com/SlyMarbo/spdy"
+//              "net/http"
+//      )
+//
+//      func httpHandler(w http.ResponseWriter, r *http.Request) {
+//              if overloaded() {
+//                      spdy.ResetStream(w, spdy.RST_STREAM_REFUSED_STREAM)
+//                      return
+//              }
+//
+//              // ...
+//      }
+func ResetStream(w http.ResponseWriter, status StatusCode) error {
+	stream, _ := streamFrom(w)
+	switch stream := stream.(type) {
+	case *serverStreamV3:
+		return stream.reset(status)
+	case *serverStreamV2:
+		return stream.reset(status)
+	}
+	return ErrNotSPDY
 }
 
 // ListenAndServeTLS listens on the TCP network address addr
@@ -656,10 +733,9 @@ func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version float64) {
 }
 
 // PingClient is used to send PINGs with SPDY servers.
-// PingClient takes a ResponseWriter and returns a channel on
-// which a spdy.Ping will be sent when the PING response is
-// received. If the channel is closed before a spdy.Ping has
-// been sent, this indicates that the PING was unsuccessful.
+// PingClient takes a ResponseWriter and returns the
+// round-trip time once the PING response is received.
+// If ctx is done first, PingClient returns ctx.Err().
 //
 // If the underlying connection is using HTTP, and not SPDY,
 // PingClient will return the ErrNotSPDY error.
@@ -667,20 +743,23 @@ func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version float64) {
 // A simple example of sending a ping is:
 //
 //      import (
+//              "context"
 //              "github.com/SlyMarbo/spdy"
 //              "log"
 //              "net/http"
+//              "time"
 //      )
 //
 //      func httpHandler(w http.ResponseWriter, req *http.Request) {
-//              ping, err := spdy.PingClient(w)
-//              if err != nil {
+//              ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//              defer cancel()
+//              rtt, err := spdy.PingClient(ctx, w)
+//              if err == spdy.ErrNotSPDY {
 //                      // Non-SPDY connection.
+//              } else if err != nil {
+//                      // Ping was unsuccessful.
 //              } else {
-//                      resp, ok <- ping
-//                      if ok {
-//                              // Ping was successful.
-//                      }
+//                      log.Println(rtt)
 //              }
 //
 //      }
@@ -693,20 +772,18 @@ func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version float64) {
 //                      log.Fatal(err)
 //              }
 //      }
-func PingClient(w http.ResponseWriter) (<-chan Ping, error) {
-	if stream, ok := w.(Stream); !ok {
-		return nil, ErrNotSPDY
+func PingClient(ctx context.Context, w http.ResponseWriter) (time.Duration, error) {
+	if stream, ok := streamFrom(w); !ok {
+		return 0, ErrNotSPDY
 	} else {
-		return stream.Conn().Ping()
+		return stream.Conn().Ping(ctx)
 	}
 }
 
 // PingServer is used to send PINGs with http.Clients using.
-// SPDY. PingServer takes a ResponseWriter and returns a
-// channel onwhich a spdy.Ping will be sent when the PING
-// response is received. If the channel is closed before a
-// spdy.Ping has been sent, this indicates that the PING was
-// unsuccessful.
+// SPDY. PingServer takes an http.Client and a server URL, and
+// returns the round-trip time once the PING response is
+// received. If ctx is done first, PingServer returns ctx.Err().
 //
 // If the underlying connection is using HTTP, and not SPDY,
 // PingServer will return the ErrNotSPDY error.
@@ -717,8 +794,10 @@ func PingClient(w http.ResponseWriter) (<-chan Ping, error) {
 // A simple example of sending a ping is:
 //
 //      import (
+//              "context"
 //              "github.com/SlyMarbo/spdy"
 //              "net/http"
+//              "time"
 //      )
 //
 //      func main() {
@@ -726,23 +805,22 @@ func PingClient(w http.ResponseWriter) (<-chan Ping, error) {
 //
 //              // ...
 //
-//              ping, err := spdy.PingServer(http.DefaultClient, "https://example.com")
+//              ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//              defer cancel()
+//              rtt, err := spdy.PingServer(ctx, *http.DefaultClient, "https://example.com")
 //              if err != nil {
-//                      // No SPDY connection.
+//                      // No SPDY connection, or ping was unsuccessful.
 //              } else {
-//                      resp, ok <- ping
-//                      if ok {
-//                              // Ping was successful.
-//                      }
+//                      log.Println(rtt)
 //              }
 //      }
-func PingServer(c http.Client, server string) (<-chan Ping, error) {
+func PingServer(ctx context.Context, c http.Client, server string) (time.Duration, error) {
 	if transport, ok := c.Transport.(*Transport); !ok {
-		return nil, ErrNotSPDY
+		return 0, ErrNotSPDY
 	} else {
 		u, err := url.Parse(server)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 		// Make sure the URL host contains the port.
 		if !strings.Contains(u.Host, ":") {
@@ -754,11 +832,13 @@ func PingServer(c http.Client, server string) (<-chan Ping, error) {
 				u.Host += ":443"
 			}
 		}
+		transport.m.Lock()
 		conn, ok := transport.spdyConns[u.Host]
+		transport.m.Unlock()
 		if !ok || conn == nil {
-			return nil, ErrNotConnected
+			return 0, ErrNotConnected
 		}
-		return conn.Ping()
+		return conn.Ping(ctx)
 	}
 }
 
@@ -767,6 +847,10 @@ func PingServer(c http.Client, server string) (<-chan Ping, error) {
 // being pushed, and returns a ResponseWriter to which the
 // push should be written.
 //
+// The push is announced to the client before any data written
+// to w after Push returns, so the client learns of the push
+// before it reads any reference to the resource.
+//
 // If the underlying connection is using HTTP, and not SPDY,
 // Push will return the ErrNotSPDY error.
 //
@@ -779,7 +863,7 @@ func PingServer(c http.Client, server string) (<-chan Ping, error) {
 //      )
 //
 //      func httpHandler(w http.ResponseWriter, r *http.Request) {
-//              path := r.URL.Scheme + "://" + r.URL.Host + "/javascript.js"
+//              path := "https://" + r.Host + "/javascript.js"
 //              push, err := spdy.Push(w, path)
 //              if err != nil {
 //                      // Non-SPDY connection.
@@ -799,17 +883,38 @@ func PingServer(c http.Client, server string) (<-chan Ping, error) {
 //              }
 //      }
 func Push(w http.ResponseWriter, url string) (PushStream, error) {
-	if stream, ok := w.(Stream); !ok {
+	if stream, ok := streamFrom(w); !ok {
 		return nil, ErrNotSPDY
 	} else {
 		return stream.Conn().Push(url, stream)
 	}
 }
 
+// PushWithOptions is like Push, but allows the pushed request's
+// method, headers and priority, and the pushed response's status
+// and headers, to be set with opts. A nil opts is equivalent to
+// using Push.
+//
+// For example, to push a stylesheet with a long cache lifetime:
+//
+//      push, err := spdy.PushWithOptions(w, path, &spdy.PushOptions{
+//              ResponseHeader: http.Header{
+//                      "Cache-Control": {"max-age=86400"},
+//                      "Content-Type":  {"text/css"},
+//              },
+//      })
+func PushWithOptions(w http.ResponseWriter, url string, opts *PushOptions) (PushStream, error) {
+	if stream, ok := streamFrom(w); !ok {
+		return nil, ErrNotSPDY
+	} else {
+		return stream.Conn().PushWithOptions(url, stream, opts)
+	}
+}
+
 // SetFlowControl can be used to set the flow control mechanism on
 // the underlying SPDY connection.
 func SetFlowControl(w http.ResponseWriter, f FlowControl) error {
-	if stream, ok := w.(Stream); !ok {
+	if stream, ok := streamFrom(w); !ok {
 		return ErrNotSPDY
 	} else {
 		return stream.Conn().SetFlowControl(f)
@@ -820,30 +925,17 @@ func SetFlowControl(w http.ResponseWriter, f FlowControl) error {
 // connection used by the given http.ResponseWriter. This is 0 for
 // connections not using SPDY.
 func SPDYversion(w http.ResponseWriter) float64 {
-	if stream, ok := w.(Stream); ok {
-		switch stream.Conn().(type) {
-		case *connV3:
-			switch stream.Conn().(*connV3).subversion {
-			case 0:
-				return 3
-			case 1:
-				return 3.1
-			default:
-				return 0
-			}
-
-		case *connV2:
-			return 2
-
-		default:
-			return 0
-		}
+	if stream, ok := streamFrom(w); ok {
+		return connVersion(stream.Conn())
 	}
 	return 0
 }
 
 // UsingSPDY indicates whether a given ResponseWriter is using SPDY.
+// As with the other helpers taking a ResponseWriter, any
+// ResponseWriters wrapped by middleware are unwrapped using
+// their Unwrap method, as with http.ResponseController.
 func UsingSPDY(w http.ResponseWriter) bool {
-	_, ok := w.(Stream)
+	_, ok := streamFrom(w)
 	return ok
 }
@@ -0,0 +1,158 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PeerSettings returns a copy of the most recent value of each
+// setting received from the other endpoint.
+func (conn *connV3) PeerSettings() Settings {
+	conn.Lock()
+	defer conn.Unlock()
+	return copySettings(conn.receivedSettings)
+}
+
+// SendSettings sends a SETTINGS frame containing the given
+// settings to the other endpoint, such as to lower
+// MAX_CONCURRENT_STREAMS under load. A new INITIAL_WINDOW_SIZE
+// also adjusts the transfer windows of open streams, and is
+// used for new streams.
+func (conn *connV3) SendSettings(settings Settings) error {
+	if conn.closed() {
+		return ErrConnClosed
+	}
+
+	if err := checkSettings(settings); err != nil {
+		return err
+	}
+
+	window, setWindow := settings[SETTINGS_INITIAL_WINDOW_SIZE]
+	if setWindow && window.Value > MAX_DELTA_WINDOW_SIZE {
+		return errors.New("Error: INITIAL_WINDOW_SIZE setting is too large.")
+	}
+
+	if setting, ok := settings[SETTINGS_MAX_CONCURRENT_STREAMS]; ok {
+		// This limits the streams the other endpoint may open.
+		if conn.server == nil {
+			conn.pushStreamLimit.SetLimit(setting.Value)
+		} else {
+			conn.requestStreamLimit.SetLimit(setting.Value)
+		}
+	}
+
+	if setWindow {
+		conn.Lock()
+		f := conn.flowControl
+		if override, ok := f.(initialWindowFlowControl); ok {
+			f = override.FlowControl
+		}
+		conn.flowControl = initialWindowFlowControl{f, window.Value}
+		for _, stream := range conn.streams {
+			if flow := streamFlowV3(stream); flow != nil {
+				flow.UpdateInitialWindowThere(window.Value)
+			}
+		}
+		conn.Unlock()
+	}
+
+	frame := new(settingsFrameV3)
+	frame.Settings = copySettings(settings)
+	conn.output[0] <- frame
+	return nil
+}
+
+// PeerSettings returns a copy of the most recent value of each
+// setting received from the other endpoint.
+func (conn *connV2) PeerSettings() Settings {
+	conn.Lock()
+	defer conn.Unlock()
+	return copySettings(conn.receivedSettings)
+}
+
+// SendSettings sends a SETTINGS frame containing the given
+// settings to the other endpoint, such as to lower
+// MAX_CONCURRENT_STREAMS under load. SPDY/2 has no flow
+// control, so INITIAL_WINDOW_SIZE has no local effect.
+func (conn *connV2) SendSettings(settings Settings) error {
+	if conn.closed() {
+		return ErrConnClosed
+	}
+
+	if err := checkSettings(settings); err != nil {
+		return err
+	}
+
+	if setting, ok := settings[SETTINGS_MAX_CONCURRENT_STREAMS]; ok {
+		// This limits the streams the other endpoint may open.
+		if conn.server == nil {
+			conn.pushStreamLimit.SetLimit(setting.Value)
+		} else {
+			conn.requestStreamLimit.SetLimit(setting.Value)
+		}
+	}
+
+	frame := new(settingsFrameV2)
+	frame.Settings = copySettings(settings)
+	conn.output[0] <- frame
+	return nil
+}
+
+// checkSettings ensures that each setting has a known ID,
+// and is stored under that ID.
+func checkSettings(settings Settings) error {
+	for id, setting := range settings {
+		if setting == nil {
+			return fmt.Errorf("Error: Setting %d is nil.", id)
+		}
+		if setting.ID != id {
+			return fmt.Errorf("Error: Setting %d stored under ID %d.", setting.ID, id)
+		}
+		if _, ok := settingText[id]; !ok {
+			return fmt.Errorf("Error: Unknown setting ID %d.", id)
+		}
+	}
+	return nil
+}
+
+// copySettings returns a duplicate of the provided Settings.
+func copySettings(settings Settings) Settings {
+	out := make(Settings, len(settings))
+	for id, setting := range settings {
+		s := *setting
+		out[id] = &s
+	}
+	return out
+}
+
+// streamFlowV3 returns the flow control of a SPDY/3 stream,
+// or nil if it has none.
+func streamFlowV3(stream Stream) *flowControl {
+	switch stream := stream.(type) {
+	case *serverStreamV3:
+		return stream.flow
+	case *clientStreamV3:
+		return stream.flow
+	case *pushStreamV3:
+		return stream.flow
+	case *rawStreamV3:
+		return stream.flow
+	}
+	return nil
+}
+
+// initialWindowFlowControl is used to override the initial
+// window size given by a FlowControl, once a new value for
+// INITIAL_WINDOW_SIZE has been sent to the other endpoint.
+type initialWindowFlowControl struct {
+	FlowControl
+	initialWindowSize uint32
+}
+
+func (f initialWindowFlowControl) InitialWindowSize() uint32 {
+	return f.initialWindowSize
+}
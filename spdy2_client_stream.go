@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 )
 
 // clientStreamV2 is a structure that implements
@@ -21,12 +23,17 @@ type clientStreamV2 struct {
 	streamID     StreamID
 	state        *StreamState
 	output       chan<- Frame
+	priority     Priority
 	request      *http.Request
 	receiver     Receiver
 	header       http.Header
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
+	err          error
+
+	readDeadline  deadline
+	writeDeadline deadline
 }
 
 /***********************
@@ -39,8 +46,12 @@ func (s *clientStreamV2) Header() http.Header {
 
 // Write is one method with which request data is sent.
 func (s *clientStreamV2) Write(inputData []byte) (int, error) {
+	if err := s.writeDeadline.err(); err != nil {
+		return 0, err
+	}
+
 	if s.closed() || s.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
 	}
 
 	// Copy the data locally to avoid any pointer issues.
@@ -59,6 +70,7 @@ func (s *clientStreamV2) Write(inputData []byte) (int, error) {
 		s.output <- dataFrame
 
 		written += MAX_DATA_SIZE
+		data = data[MAX_DATA_SIZE:]
 	}
 
 	n := len(data)
@@ -89,8 +101,10 @@ func (s *clientStreamV2) Close() error {
 	s.Lock()
 	defer s.Unlock()
 	s.writeHeader()
+	s.readDeadline.stop()
+	s.writeDeadline.stop()
 	if s.state != nil {
-		if s.state.OpenThere() {
+		if !s.state.Closed() {
 			// Send the RST_STREAM.
 			rst := new(rstStreamFrameV2)
 			rst.StreamID = s.streamID
@@ -149,16 +163,14 @@ func (s *clientStreamV2) ReceiveFrame(frame Frame) error {
 		s.receiver.ReceiveData(s.request, data, frame.Flags.FIN())
 
 		if frame.Flags.FIN() {
-			s.state.CloseThere()
-			close(s.finished)
+			s.finish()
 		}
 
 	case *synReplyFrameV2:
 		s.receiver.ReceiveHeader(s.request, frame.Header)
 
 		if frame.Flags.FIN() {
-			s.state.CloseThere()
-			close(s.finished)
+			s.finish()
 		}
 
 	case *headersFrameV2:
@@ -183,14 +195,81 @@ func (s *clientStreamV2) CloseNotify() <-chan bool {
 // processed, and then the stream
 // is cleaned up and closed.
 func (s *clientStreamV2) Run() error {
-	// Receive and process inbound frames.
-	<-s.finished
+	// Receive and process inbound frames,
+	// reporting a reset by the server.
+	if err := s.wait(); err != nil {
+		return err
+	}
 
 	// Clean up state.
 	s.state.CloseHere()
 	return nil
 }
 
+// Priority returns the stream's current priority.
+func (s *clientStreamV2) Priority() Priority {
+	s.Lock()
+	defer s.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority of the frames the
+// stream sends from now on. Frames already handed to the
+// connection keep their original priority.
+func (s *clientStreamV2) SetPriority(priority Priority) error {
+	if !priority.Valid(2) {
+		return errors.New("Error: Priority must be in the range 0 - 3.")
+	}
+
+	conn, ok := s.conn.(*connV2)
+	if !ok || s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.priority = priority
+	s.output = conn.reprioritise(s.streamID, priority)
+	return nil
+}
+
+// SetReadDeadline sets the time by which the response
+// must have been received. If the server is still sending
+// when the deadline passes, the stream is cancelled with
+// RST_STREAM_CANCEL, and Run returns os.ErrDeadlineExceeded.
+// A zero time removes the deadline.
+func (s *clientStreamV2) SetReadDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.readDeadline.set(t, func() {
+		if s.state.OpenThere() {
+			s.deadlineExceeded()
+		}
+	})
+	return nil
+}
+
+// SetWriteDeadline sets the time by which the request
+// must have been sent. If the request is unfinished when
+// the deadline passes, the stream is cancelled with
+// RST_STREAM_CANCEL, and Run returns os.ErrDeadlineExceeded.
+// Writes after the deadline also fail with
+// os.ErrDeadlineExceeded. A zero time removes the deadline.
+func (s *clientStreamV2) SetWriteDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.writeDeadline.set(t, func() {
+		if s.state.OpenHere() {
+			s.deadlineExceeded()
+		}
+	})
+	return nil
+}
+
 func (s *clientStreamV2) State() *StreamState {
 	return s.state
 }
@@ -199,6 +278,78 @@ func (s *clientStreamV2) StreamID() StreamID {
 	return s.streamID
 }
 
+// resetByPeer closes the stream after the server has
+// reset it with RST_STREAM, recording the status so that
+// Run can report it.
+func (s *clientStreamV2) resetByPeer(status StatusCode) {
+	s.Lock()
+	if s.err == nil {
+		s.err = &StreamError{ID: s.streamID, Status: status}
+	}
+	if s.state != nil {
+		s.state.Close()
+	}
+	s.Unlock()
+	s.Close()
+}
+
+// deadlineExceeded cancels the stream once one of its
+// deadlines has passed, so that Run reports the error.
+func (s *clientStreamV2) deadlineExceeded() {
+	s.Lock()
+	if s.err == nil {
+		s.err = os.ErrDeadlineExceeded
+	}
+	s.Unlock()
+	s.Close()
+}
+
+// closeWrite finishes the request body with an
+// empty DATA frame carrying FIN.
+func (s *clientStreamV2) closeWrite() error {
+	if s.closed() || s.state.ClosedHere() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+
+	data := new(dataFrameV2)
+	data.StreamID = s.streamID
+	data.Flags = FLAG_FIN
+	data.Data = []byte{}
+	s.output <- data
+
+	s.state.CloseHere()
+	return nil
+}
+
+// finish marks the response as having been
+// received in full.
+func (s *clientStreamV2) finish() {
+	s.Lock()
+	defer s.Unlock()
+	if s.state != nil {
+		s.state.CloseThere()
+	}
+	select {
+	case <-s.finished:
+	default:
+		close(s.finished)
+	}
+}
+
+// wait blocks until the response has been
+// received, or the stream has been closed,
+// and returns the reason for any reset.
+func (s *clientStreamV2) wait() error {
+	<-s.finished
+
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
 func (s *clientStreamV2) closed() bool {
 	if s.conn == nil || s.state == nil || s.receiver == nil {
 		return true
@@ -7,6 +7,7 @@ package spdy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -14,8 +15,11 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,10 +32,12 @@ type connV2 struct {
 	server              *http.Server
 	conn                net.Conn
 	buf                 *bufio.Reader
+	counter             *countingReader // counts the bytes read into buf.
 	tlsState            *tls.ConnectionState
 	streams             map[StreamID]Stream            // map of active streams.
 	output              [8]chan Frame                  // one output channel per priority level.
-	pings               map[uint32]chan<- Ping         // response channel for pings.
+	pings               map[uint32]chan time.Duration  // response channel for pings, given the round-trip time.
+	pingSent            map[uint32]time.Time           // time each outbound ping was sent.
 	nextPingID          uint32                         // next outbound ping ID.
 	compressor          Compressor                     // outbound compression state.
 	decompressor        Decompressor                   // inbound decompression state.
@@ -53,6 +59,18 @@ type connV2 struct {
 	readTimeout         time.Duration                  // optional timeout for network reads.
 	writeTimeout        time.Duration                  // optional timeout for network writes.
 	pushedResources     map[Stream]map[string]struct{} // used to prevent duplicate headers being pushed.
+	capture             atomic.Value                   // optional *CaptureWriter recording the frames sent and received.
+	stats               *connStats                     // statistics for this connection.
+	keepAliveStop       chan struct{}                  // this channel is closed to stop the keepalive.
+	idleStop            chan struct{}                  // this channel is closed to stop the idle timeout.
+	lastActive          time.Time                      // last time a stream was seen to be active.
+	requestTimeout      time.Duration                  // maximum time to receive and handle each request.
+	timeoutStatus       StatusCode                     // RST_STREAM status sent when requestTimeout is exceeded.
+	pushPreload         bool                           // push resources named in Link: rel=preload headers.
+	pushPolicy          *PushPolicy                    // learns which resources to push.
+	pushHistory         *pushHistory                   // pages and resources sent, for pushPolicy.
+	pushLock            sync.Mutex                     // serialises the sending of server pushes.
+	err                 error                          // reason the connection ended, returned by Run.
 }
 
 // Close ends the connection, cleaning up relevant resources.
@@ -100,9 +118,11 @@ func (conn *connV2) Close() (err error) {
 		close(conn.stop)
 	}
 
+	// The connection, compressor and decompressor are
+	// left in place, as the send and receive loops may
+	// still be using them.
 	if conn.conn != nil {
 		conn.conn.Close()
-		conn.conn = nil
 	}
 
 	for _, stream := range conn.streams {
@@ -115,9 +135,7 @@ func (conn *connV2) Close() (err error) {
 
 	if conn.compressor != nil {
 		conn.compressor.Close()
-		conn.compressor = nil
 	}
-	conn.decompressor = nil
 
 	conn.pushedResources = nil
 
@@ -143,20 +161,27 @@ func (c *connV2) Conn() net.Conn {
 	return c.conn
 }
 
+// Accept is not supported, as raw streams
+// require SPDY/3 or later.
+func (conn *connV2) Accept() (RawStream, error) {
+	return nil, ErrNoRawStreams
+}
+
 // InitialWindowSize gives the most recently-received value for
 // the INITIAL_WINDOW_SIZE setting.
 func (conn *connV2) InitialWindowSize() (uint32, error) {
 	return conn.initialWindowSize, nil
 }
 
-// Ping is used by spdy.PingServer and spdy.PingClient to send
-// SPDY PINGs.
-func (conn *connV2) Ping() (<-chan Ping, error) {
+// Ping sends a SPDY PING and waits for the response, returning
+// the round-trip time. If ctx is done before the response is
+// received, Ping gives up and returns ctx.Err().
+func (conn *connV2) Ping(ctx context.Context) (time.Duration, error) {
 	conn.Lock()
-	defer conn.Unlock()
 
 	if conn.closed() {
-		return nil, errors.New("Error: Conn has been closed.")
+		conn.Unlock()
+		return 0, ErrConnClosed
 	}
 
 	ping := new(pingFrameV2)
@@ -171,23 +196,77 @@ func (conn *connV2) Ping() (<-chan Ping, error) {
 		conn.nextPingID += 2
 	}
 	ping.PingID = pid
-	conn.output[0] <- ping
-	c := make(chan Ping, 1)
+	c := make(chan time.Duration, 1)
 	conn.pings[pid] = c
+	conn.pingSent[pid] = time.Now()
+	conn.Unlock()
+
+	// The lock is not held while sending, as
+	// the send loop may already have stopped.
+	select {
+	case conn.output[0] <- ping:
+	case <-conn.stop:
+		conn.forgetPing(pid)
+		return 0, ErrConnClosed
+	case <-ctx.Done():
+		conn.forgetPing(pid)
+		return 0, ctx.Err()
+	}
 
-	return c, nil
+	select {
+	case rtt := <-c:
+		return rtt, nil
+	case <-conn.stop:
+		conn.forgetPing(pid)
+		return 0, ErrConnClosed
+	case <-ctx.Done():
+		conn.forgetPing(pid)
+		return 0, ctx.Err()
+	}
+}
+
+// forgetPing discards a PING which is no
+// longer awaited.
+func (conn *connV2) forgetPing(pid uint32) {
+	conn.Lock()
+	delete(conn.pings, pid)
+	delete(conn.pingSent, pid)
+	conn.Unlock()
 }
 
 // Push is used to issue a server push to the client. Note that this cannot be performed
 // by clients.
 func (conn *connV2) Push(resource string, origin Stream) (PushStream, error) {
+	return conn.PushWithOptions(resource, origin, nil)
+}
+
+// PushWithOptions is used to issue a server push to the client, as described by opts.
+// Note that this cannot be performed by clients.
+func (conn *connV2) PushWithOptions(resource string, origin Stream, opts *PushOptions) (PushStream, error) {
 	if conn.goawayReceived || conn.goawaySent {
 		return nil, ErrGoaway
 	}
 
 	if conn.server == nil {
-		return nil, errors.New("Error: Only servers can send pushes.")
+		return nil, ErrServerOnly
+	}
+
+	// Check the origin stream can be used.
+	if err := checkPushOrigin(conn, origin); err != nil {
+		return nil, err
+	}
+	conn.Lock()
+	_, ok := conn.streams[origin.StreamID()]
+	conn.Unlock()
+	if !ok {
+		return nil, errors.New("Error: Origin stream is closed.")
+	}
+
+	opts, err := pushOptions(opts, origin, 2)
+	if err != nil {
+		return nil, err
 	}
+	priority := *opts.Priority
 
 	// Parse and check URL.
 	url, err := url.Parse(resource)
@@ -199,6 +278,12 @@ func (conn *connV2) Push(resource string, origin Stream) (PushStream, error) {
 	}
 	resource = url.String()
 
+	// Check the resource shares the origin's authority.
+	request := streamRequest(origin)
+	if request == nil || !pushAuthorized(url, request, conn.tlsState != nil, serverCertificates(conn.server)) {
+		return nil, errors.New("Error: Pushed resource must have the same origin as the origin stream.")
+	}
+
 	// Ensure the resource hasn't been pushed on the given stream already.
 	if conn.pushedResources[origin] == nil {
 		conn.pushedResources[origin] = map[string]struct{}{
@@ -212,32 +297,49 @@ func (conn *connV2) Push(resource string, origin Stream) (PushStream, error) {
 
 	// Check stream limit would allow the new stream.
 	if !conn.pushStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return nil, &StreamError{Status: RST_STREAM_REFUSED_STREAM}
 	}
 
-	// Prepare the SYN_STREAM.
+	// Prepare the SYN_STREAM. In SPDY/2, the
+	// response's status and headers are sent
+	// with the request.
+	path := url.Path
+	if url.RawQuery != "" {
+		path += "?" + url.RawQuery
+	}
 	push := new(synStreamFrameV2)
 	push.Flags = FLAG_UNIDIRECTIONAL
 	push.AssocStreamID = origin.StreamID()
-	push.Priority = 3
-	push.Header = make(http.Header)
+	push.Priority = priority
+	push.Header = opts.Header
+	for name, values := range opts.ResponseHeader {
+		for _, value := range values {
+			push.Header.Add(name, value)
+		}
+	}
+	push.Header.Set("method", opts.Method)
 	push.Header.Set("scheme", url.Scheme)
 	push.Header.Set("host", url.Host)
-	push.Header.Set("url", url.Path)
+	push.Header.Set("url", path)
 	push.Header.Set("version", "HTTP/1.1")
-	push.Header.Set(":status", "200 OK")
+	push.Header.Set("status", strconv.Itoa(opts.Status))
 
-	// Send.
-	conn.Lock()
-	defer conn.Unlock()
+	// Send. Pushes are sent one at a time, so that their
+	// stream IDs reach the client in order. The connection
+	// is not locked while the SYN_STREAM is handed to the
+	// sender, which may need the lock to make progress.
+	conn.pushLock.Lock()
+	defer conn.pushLock.Unlock()
 
+	conn.Lock()
 	conn.lastPushStreamID += 2
 	if conn.lastPushStreamID > MAX_STREAM_ID {
+		conn.pushStreamLimit.Close()
+		conn.Unlock()
 		return nil, errors.New("Error: All server streams exhausted.")
 	}
 	newID := conn.lastPushStreamID
 	push.StreamID = newID
-	conn.output[0] <- push
 
 	// Create the pushStream.
 	out := new(pushStreamV2)
@@ -245,29 +347,71 @@ func (conn *connV2) Push(resource string, origin Stream) (PushStream, error) {
 	out.streamID = newID
 	out.origin = origin
 	out.state = new(StreamState)
-	out.output = conn.output[3]
+	out.output = conn.output[priority]
+	out.priority = priority
 	out.header = make(http.Header)
 	out.stop = conn.stop
 
 	// Store in the connection map.
-	conn.streams[newID] = out
+	conn.addStream(newID, out)
+	conn.Unlock()
+
+	// The SYN_STREAM has been received by the sender
+	// once this completes, so it is written before any
+	// DATA sent later on the origin stream, whatever
+	// their priorities.
+	select {
+	case conn.output[0] <- push:
+	case <-conn.stop:
+		return nil, ErrConnClosed
+	}
 
 	return out, nil
 }
 
+// OpenStream is not supported, as raw
+// streams require SPDY/3 or later.
+func (conn *connV2) OpenStream(http.Header, Priority) (RawStream, error) {
+	return nil, ErrNoRawStreams
+}
+
 // Request is used to make a client request.
 func (conn *connV2) Request(request *http.Request, receiver Receiver, priority Priority) (Stream, error) {
+	stream, err := conn.request(request, receiver, priority, false)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// RequestDuplex is used to make a client request whose
+// body is written while the response is received.
+func (conn *connV2) RequestDuplex(request *http.Request, priority Priority) (*DuplexStream, error) {
+	res := newDuplexResponse(request, "status", "version")
+	res.TLS = conn.tlsState
+	stream, err := conn.request(request, res, priority, true)
+	if err != nil {
+		return nil, err
+	}
+	return newDuplexStream(stream, res), nil
+}
+
+// request sends the SYN_STREAM for a client request. If
+// duplex is false, the request body is sent at once, and
+// the stream is half-closed. Otherwise, the request body
+// is left to be written to the stream.
+func (conn *connV2) request(request *http.Request, receiver Receiver, priority Priority, duplex bool) (*clientStreamV2, error) {
 	if conn.goawayReceived || conn.goawaySent {
 		return nil, ErrGoaway
 	}
 
 	if conn.server != nil {
-		return nil, errors.New("Error: Only clients can send requests.")
+		return nil, ErrClientOnly
 	}
 
 	// Check stream limit would allow the new stream.
 	if !conn.requestStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return nil, &StreamError{Status: RST_STREAM_REFUSED_STREAM}
 	}
 
 	if !priority.Valid(2) {
@@ -298,7 +442,9 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 
 	// Prepare the request body, if any.
 	body := make([]*dataFrameV2, 0, 1)
-	if request.Body != nil {
+	if duplex {
+		// The body is written to the stream later.
+	} else if request.Body != nil {
 		buf := make([]byte, 32*1024)
 		n, err := request.Body.Read(buf)
 		if err != nil && err != io.EOF {
@@ -339,6 +485,7 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 		conn.lastRequestStreamID += 2
 	}
 	if conn.lastRequestStreamID > MAX_STREAM_ID {
+		conn.requestStreamLimit.Close()
 		return nil, errors.New("Error: All client streams exhausted.")
 	}
 	syn.StreamID = conn.lastRequestStreamID
@@ -353,8 +500,11 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 	out.conn = conn
 	out.streamID = syn.StreamID
 	out.state = new(StreamState)
-	out.state.CloseHere()
-	out.output = conn.output[0]
+	if !duplex {
+		out.state.CloseHere()
+	}
+	out.output = conn.output[priority]
+	out.priority = priority
 	out.request = request
 	out.receiver = receiver
 	out.header = make(http.Header)
@@ -362,7 +512,7 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 	out.finished = make(chan struct{})
 
 	// Store in the connection map.
-	conn.streams[syn.StreamID] = out
+	conn.addStream(syn.StreamID, out)
 
 	return out, nil
 }
@@ -372,6 +522,9 @@ func (c *connV2) RequestResponse(request *http.Request, receiver Receiver, prior
 	res.Request = request
 	res.Data = new(bytes.Buffer)
 	res.Receiver = receiver
+	res.TLS = c.tlsState
+	res.statusHeader = "status"
+	res.versionHeader = "version"
 
 	// Send the request.
 	stream, err := c.Request(request, res, priority)
@@ -379,8 +532,13 @@ func (c *connV2) RequestResponse(request *http.Request, receiver Receiver, prior
 		return nil, err
 	}
 
-	// Let the request run its course.
-	stream.Run()
+	// Let the request run its course, reporting
+	// a reset by the server or an exceeded deadline.
+	if err := stream.Run(); err != nil {
+		if _, ok := err.(*StreamError); ok || err == os.ErrDeadlineExceeded {
+			return nil, err
+		}
+	}
 
 	return res.Response(), nil
 }
@@ -409,13 +567,59 @@ func (conn *connV2) Run() error {
 	// Run until the connection ends.
 	<-conn.stop
 
-	return nil
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.err
 }
 
 func (c *connV2) SetFlowControl(FlowControl) error {
 	return ErrNoFlowControl
 }
 
+// SetKeepAlive starts sending a PING every interval, closing the
+// connection if maxMissed consecutive PINGs go unanswered. This
+// can be used to detect half-open connections. If maxMissed is
+// less than 1, 1 is used. An interval of 0 stops the keepalive.
+func (c *connV2) SetKeepAlive(interval time.Duration, maxMissed int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.keepAliveStop != nil {
+		close(c.keepAliveStop)
+		c.keepAliveStop = nil
+	}
+	if interval <= 0 || c.closed() {
+		return
+	}
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+	c.keepAliveStop = make(chan struct{})
+	go keepAlive(c, interval, maxMissed, c.keepAliveStop)
+}
+
+// SetIdleTimeout closes the connection, with a GOAWAY, once it
+// has had no active streams for the given duration. A timeout
+// of 0 disables the idle timeout.
+func (c *connV2) SetIdleTimeout(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.idleStop != nil {
+		close(c.idleStop)
+		c.idleStop = nil
+	}
+	if d <= 0 || c.closed() {
+		return
+	}
+	c.idleStop = make(chan struct{})
+	go idleTimeout(c, d, c.idleStop)
+}
+
+// SetRawStreams has no effect, as raw
+// streams require SPDY/3 or later.
+func (c *connV2) SetRawStreams(bool) {}
+
 func (c *connV2) SetTimeout(d time.Duration) {
 	c.Lock()
 	c.readTimeout = d
@@ -446,6 +650,67 @@ func (conn *connV2) closed() bool {
 	}
 }
 
+// activeStreams returns the number of streams
+// which have not yet been closed.
+func (conn *connV2) activeStreams() int {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.reapStreams()
+}
+
+// lastActivity returns the last time the
+// connection was seen to have active streams.
+func (conn *connV2) lastActivity() time.Time {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.reapStreams()
+	return conn.lastActive
+}
+
+// addStream stores a new stream in the connection map.
+// The stream's place in the stream limits is freed as
+// soon as it is closed. The caller must hold the
+// connection's lock.
+func (conn *connV2) addStream(sid StreamID, stream Stream) {
+	conn.streams[sid] = stream
+	limit := conn.requestStreamLimit
+	if sid&1 == 0 {
+		limit = conn.pushStreamLimit
+	}
+	stream.State().onClose(limit.Close)
+}
+
+// reapStreams removes closed streams from the connection,
+// and returns the number of streams which remain active.
+// The caller must hold the connection's lock.
+func (conn *connV2) reapStreams() int {
+	active := 0
+	for sid, stream := range conn.streams {
+		if state := stream.State(); state != nil && !state.Closed() {
+			active++
+			continue
+		}
+
+		delete(conn.streams, sid)
+		delete(conn.pushedResources, stream)
+		conn.lastActive = time.Now()
+	}
+	if active > 0 {
+		conn.lastActive = time.Now()
+	}
+	return active
+}
+
+// setError records the reason the connection is ending,
+// which is returned by Run. Only the first reason is kept.
+func (conn *connV2) setError(err error) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.err == nil {
+		conn.err = err
+	}
+}
+
 // handleClientData performs the processing of DATA frames sent by the client.
 func (conn *connV2) handleClientData(frame *dataFrameV2) {
 	conn.Lock()
@@ -504,9 +769,16 @@ func (conn *connV2) handleHeaders(frame *headersFrameV2) {
 	// Handle push headers.
 	if sid&1 == 0 && conn.server == nil {
 		// Ignore refused push headers.
+		req := conn.pushRequests[sid]
+		if req != nil && frame.Flags.FIN() {
+			conn.endPush(sid)
+		}
 		conn.Unlock()
-		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
+		if req != nil {
 			conn.pushReceiver.ReceiveHeader(req, frame.Header)
+			if frame.Flags.FIN() {
+				conn.pushReceiver.ReceiveData(req, []byte{}, true)
+			}
 		}
 		return
 	}
@@ -577,29 +849,44 @@ func (conn *connV2) handlePush(frame *synStreamFrameV2) {
 
 	// Stream ID is fine.
 
-	// Check stream limit would allow the new stream.
-	if !conn.pushStreamLimit.Add() {
-		rst := new(rstStreamFrameV2)
-		rst.StreamID = sid
-		rst.Status = RST_STREAM_REFUSED_STREAM
-		conn.output[0] <- rst
+	if !frame.Priority.Valid(2) {
+		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
 		conn.Unlock()
+		conn.protocolError(sid)
 		return
 	}
 
-	if !frame.Priority.Valid(2) {
-		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
+	// Check the push is associated with an open request.
+	assoc, ok := conn.streams[frame.AssocStreamID]
+	if frame.AssocStreamID&1 == 0 || !ok || assoc.State().ClosedThere() {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, associated with stream %d, which is not open.\n", sid, frame.AssocStreamID)
+		conn.numBenignErrors++
+		conn.refusePush(sid, RST_STREAM_INVALID_STREAM)
 		conn.Unlock()
-		conn.protocolError(sid)
 		return
 	}
 
 	// Parse the request.
 	header := frame.Header
+	if header.Get("scheme") == "" || header.Get("host") == "" || header.Get("url") == "" {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which is missing the pushed URL.\n", sid)
+		conn.refusePush(sid, RST_STREAM_PROTOCOL_ERROR)
+		conn.Unlock()
+		return
+	}
 	rawUrl := header.Get("scheme") + "://" + header.Get("host") + header.Get("url")
 	url, err := url.Parse(rawUrl)
 	if err != nil {
 		log.Println("Error: Received SYN_STREAM with invalid request URL: ", err)
+		conn.refusePush(sid, RST_STREAM_PROTOCOL_ERROR)
+		conn.Unlock()
+		return
+	}
+
+	// Check the server is authoritative for the resource.
+	if origin := streamRequest(assoc); origin == nil || !pushAuthorized(url, origin, conn.tlsState != nil, peerCertificates(conn.tlsState)) {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, pushing %q, which is not from the same origin.\n", sid, url)
+		conn.refusePush(sid, RST_STREAM_REFUSED_STREAM)
 		conn.Unlock()
 		return
 	}
@@ -627,24 +914,42 @@ func (conn *connV2) handlePush(frame *synStreamFrameV2) {
 		TLS:        conn.tlsState,
 	}
 
+	// Check stream limit would allow the new stream.
+	if !conn.pushStreamLimit.Add() {
+		rst := new(rstStreamFrameV2)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_REFUSED_STREAM
+		conn.output[0] <- rst
+		conn.Unlock()
+		return
+	}
+
+	// The push can be identified, such as
+	// to cancel it, using its context.
+	info := &StreamInfo{Conn: conn, StreamID: sid, Priority: frame.Priority, Version: connVersion(conn)}
+	request = request.WithContext(context.WithValue(context.Background(), streamInfoKey, info))
+
 	// Check whether the receiver wants this resource.
-	if conn.pushReceiver != nil && !conn.pushReceiver.ReceiveRequest(request) {
+	if conn.pushReceiver == nil || !conn.pushReceiver.ReceiveRequest(request) {
 		rst := new(rstStreamFrameV2)
 		rst.StreamID = sid
 		rst.Status = RST_STREAM_REFUSED_STREAM
 		conn.output[0] <- rst
+		conn.pushStreamLimit.Close()
 		conn.Unlock()
 		return
 	}
 
 	// Create and start new stream.
-	if conn.pushReceiver != nil {
-		conn.pushRequests[sid] = request
-		conn.lastPushStreamID = sid
-		conn.Unlock()
-		conn.pushReceiver.ReceiveHeader(request, frame.Header)
-	} else {
-		conn.Unlock()
+	conn.pushRequests[sid] = request
+	conn.lastPushStreamID = sid
+	if frame.Flags.FIN() {
+		conn.endPush(sid)
+	}
+	conn.Unlock()
+	conn.pushReceiver.ReceiveHeader(request, frame.Header)
+	if frame.Flags.FIN() {
+		conn.pushReceiver.ReceiveData(request, []byte{}, true)
 	}
 }
 
@@ -713,11 +1018,21 @@ func (conn *connV2) handleRequest(frame *synStreamFrameV2) {
 	nextStream := conn.newStream(frame, frame.Priority)
 	// Make sure an error didn't occur when making the stream.
 	if nextStream == nil {
+		// Reply with 400 Bad Request, as the spec requires.
+		reply := new(synReplyFrameV2)
+		reply.Flags = FLAG_FIN
+		reply.StreamID = sid
+		reply.Header = make(http.Header)
+		reply.Header.Set("status", "400")
+		reply.Header.Set("version", "HTTP/1.1")
+		conn.output[0] <- reply
+		conn.requestStreamLimit.Close()
+		conn.lastRequestStreamID = sid
 		return
 	}
 
 	// Set and prepare.
-	conn.streams[sid] = nextStream
+	conn.addStream(sid, nextStream)
 	conn.lastRequestStreamID = sid
 
 	// Start the stream.
@@ -731,28 +1046,36 @@ func (conn *connV2) handleRstStream(frame *rstStreamFrameV2) {
 
 	sid := frame.StreamID
 
+	// End any push the server has reset.
+	if sid&1 == 0 && conn.server == nil {
+		if req := conn.endPush(sid); req != nil {
+			go pushCancelled(conn.pushReceiver, req)
+		}
+	}
+
 	// Determine the status code and react accordingly.
 	switch frame.Status {
 	case RST_STREAM_INVALID_STREAM:
 		log.Printf("Error: Received INVALID_STREAM for stream ID %d.\n", sid)
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 		conn.numBenignErrors++
 
-	case RST_STREAM_REFUSED_STREAM:
+	case RST_STREAM_REFUSED_STREAM, RST_STREAM_INTERNAL_ERROR:
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 
 	case RST_STREAM_CANCEL:
-		if sid&1 == conn.oddity {
+		// Allow cancelling of requests by the server.
+		if sid&1 == conn.oddity && conn.server != nil {
 			log.Println("Error: Cannot cancel locally-sent streams.")
 			conn.numBenignErrors++
 			return
 		}
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 
 	case RST_STREAM_FLOW_CONTROL_ERROR:
@@ -767,7 +1090,7 @@ func (conn *connV2) handleRstStream(frame *rstStreamFrameV2) {
 	case RST_STREAM_STREAM_ALREADY_CLOSED:
 		log.Printf("Error: Received STREAM_ALREADY_CLOSED for stream ID %d.\n", sid)
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 		conn.numBenignErrors++
 
@@ -793,8 +1116,12 @@ func (conn *connV2) handleServerData(frame *dataFrameV2) {
 	// Handle push data.
 	if sid&1 == 0 {
 		// Ignore refused push data.
+		req := conn.pushRequests[sid]
+		if req != nil && frame.Flags.FIN() {
+			conn.endPush(sid)
+		}
 		conn.Unlock()
-		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
+		if req != nil {
 			conn.pushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
 		}
 		return
@@ -868,7 +1195,7 @@ func (conn *connV2) newStream(frame *synStreamFrameV2, priority Priority) *serve
 	stream := new(serverStreamV2)
 	stream.conn = conn
 	stream.streamID = frame.StreamID
-	stream.requestBody = new(bytes.Buffer)
+	stream.requestBody = newBodyBuffer()
 	stream.state = new(StreamState)
 	stream.output = conn.output[priority]
 	// stream.request initialised below
@@ -879,50 +1206,81 @@ func (conn *connV2) newStream(frame *synStreamFrameV2, priority Priority) *serve
 	stream.header = make(http.Header)
 	stream.unidirectional = frame.Flags.UNIDIRECTIONAL()
 	stream.responseCode = 0
-	stream.ready = make(chan struct{})
 	stream.stop = conn.stop
 	stream.wroteHeader = false
 	stream.priority = priority
+	stream.closeNotify = make(chan bool)
+	stream.timeout = conn.requestTimeout
+	stream.timeoutStatus = conn.timeoutStatus
+	stream.pushPreload = conn.pushPreload
+	stream.pushPolicy = conn.pushPolicy
+	stream.pushHistory = conn.pushHistory
 
 	if frame.Flags.FIN() {
-		close(stream.ready)
+		stream.requestBody.finish(nil)
 		stream.state.CloseThere()
 	}
 
-	header := frame.Header
-	rawUrl := header.Get("scheme") + "://" + header.Get("host") + header.Get("url")
-
-	url, err := url.Parse(rawUrl)
+	// Build this into a request to present to the Handler.
+	request, err := newServerRequest(frame.Header, requestHeadersV2, frame.Flags.FIN())
 	if err != nil {
-		log.Println("Error: Received SYN_STREAM with invalid request URL: ", err)
+		log.Println(err)
 		return nil
 	}
+	request.RemoteAddr = conn.remoteAddr
+	request.TLS = conn.tlsState
+	if request.Body == nil {
+		request.Body = stream.requestBody
+	}
+	stream.request = request
 
-	vers := header.Get("version")
-	major, minor, ok := http.ParseHTTPVersion(vers)
+	ctx := newStreamContext(serverContext(conn.server, conn.conn), stream, conn.pushStreamLimit.Limit() > 0)
+	ctx, cancel := context.WithCancel(ctx)
+	stream.request = stream.request.WithContext(ctx)
+	stream.cancel = cancel
+
+	return stream
+}
+
+// refusePush rejects a server push with RST_STREAM
+// and the given status. The connection must be locked.
+func (conn *connV2) refusePush(sid StreamID, status StatusCode) {
+	rst := new(rstStreamFrameV2)
+	rst.StreamID = sid
+	rst.Status = status
+	conn.output[0] <- rst
+}
+
+// endPush removes a server push which has finished, freeing
+// its place in the push stream limit, and returns its request.
+// The connection must be locked.
+func (conn *connV2) endPush(sid StreamID) *http.Request {
+	req, ok := conn.pushRequests[sid]
 	if !ok {
-		log.Println("Error: Invalid HTTP version: " + vers)
 		return nil
 	}
+	delete(conn.pushRequests, sid)
+	conn.pushStreamLimit.Close()
+	return req
+}
 
-	method := header.Get("method")
-
-	// Build this into a request to present to the Handler.
-	stream.request = &http.Request{
-		Method:     method,
-		URL:        url,
-		Proto:      vers,
-		ProtoMajor: major,
-		ProtoMinor: minor,
-		RemoteAddr: conn.remoteAddr,
-		Header:     header,
-		Host:       url.Host,
-		RequestURI: url.Path,
-		TLS:        conn.tlsState,
-		Body:       &readCloser{stream.requestBody},
+// cancelPush cancels an accepted server push by sending
+// RST_STREAM with status CANCEL.
+func (conn *connV2) cancelPush(sid StreamID) error {
+	conn.Lock()
+	req := conn.endPush(sid)
+	conn.Unlock()
+	if req == nil {
+		return errors.New("Error: Push is not in progress.")
 	}
 
-	return stream
+	rst := new(rstStreamFrameV2)
+	rst.StreamID = sid
+	rst.Status = RST_STREAM_CANCEL
+	conn.output[0] <- rst
+
+	pushCancelled(conn.pushReceiver, req)
+	return nil
 }
 
 // handleReadWriteError differentiates between normal and
@@ -937,6 +1295,11 @@ func (conn *connV2) handleReadWriteError(err error) {
 		log.Printf("Error: Encountered error: %q (%T)\n", err.Error(), err)
 	}
 
+	// Record the error, unless the connection was closed locally.
+	if !conn.closed() {
+		conn.setError(&ConnectionError{Cause: err})
+	}
+
 	// Make sure conn.Close succeeds and sending stops.
 	conn.Lock()
 	if conn.sending == nil {
@@ -950,6 +1313,16 @@ func (conn *connV2) handleReadWriteError(err error) {
 // protocolError informs the other endpoint that a protocol error has
 // occurred, stops all running streams, and ends the connection.
 func (conn *connV2) protocolError(streamID StreamID) {
+	lastGood := conn.lastPushStreamID
+	if conn.server != nil {
+		lastGood = conn.lastRequestStreamID
+	}
+	err := &ConnectionError{GoawayStatus: GOAWAY_PROTOCOL_ERROR, LastGoodStreamID: lastGood}
+	if streamID != 0 {
+		err.Cause = &StreamError{ID: streamID, Status: RST_STREAM_PROTOCOL_ERROR}
+	}
+	conn.setError(err)
+
 	reply := new(rstStreamFrameV2)
 	reply.StreamID = streamID
 	reply.Status = RST_STREAM_PROTOCOL_ERROR
@@ -963,11 +1336,7 @@ func (conn *connV2) protocolError(streamID StreamID) {
 
 	if !conn.goawaySent {
 		goaway := new(goawayFrameV2)
-		if conn.server != nil {
-			goaway.LastGoodStreamID = conn.lastRequestStreamID
-		} else {
-			goaway.LastGoodStreamID = conn.lastPushStreamID
-		}
+		goaway.LastGoodStreamID = lastGood
 		select {
 		case conn.output[0] <- goaway:
 			conn.goawaySent = true
@@ -1000,14 +1369,16 @@ func (conn *connV2) processFrame(frame Frame) bool {
 		if statusCodeIsFatal(frame.Status) {
 			code := statusCodeText[frame.Status]
 			log.Printf("Warning: Received %s on stream %d. Closing connection.\n", code, frame.StreamID)
-			conn.Close()
+			closeWithError(conn, &ConnectionError{Cause: &StreamError{ID: frame.StreamID, Status: frame.Status}})
 			return true
 		}
 		conn.handleRstStream(frame)
 
 	case *settingsFrameV2:
 		for _, setting := range frame.Settings {
+			conn.Lock()
 			conn.receivedSettings[setting.ID] = setting
+			conn.Unlock()
 			switch setting.ID {
 			case SETTINGS_INITIAL_WINDOW_SIZE:
 				conn.Lock()
@@ -1029,15 +1400,21 @@ func (conn *connV2) processFrame(frame Frame) bool {
 	case *pingFrameV2:
 		// Check whether Ping ID is a response.
 		if frame.PingID&1 == conn.nextPingID&1 {
-			if conn.pings[frame.PingID] == nil {
+			conn.Lock()
+			c := conn.pings[frame.PingID]
+			if c == nil {
+				conn.Unlock()
 				log.Printf("Warning: Ignored PING with Ping ID %d, which hasn't been requested.\n",
 					frame.PingID)
 				conn.numBenignErrors++
 				return false
 			}
-			conn.pings[frame.PingID] <- Ping{}
-			close(conn.pings[frame.PingID])
+			rtt := time.Since(conn.pingSent[frame.PingID])
 			delete(conn.pings, frame.PingID)
+			delete(conn.pingSent, frame.PingID)
+			conn.Unlock()
+			conn.stats.ping(rtt)
+			c <- rtt
 		} else {
 			debug.Println("Received PING. Replying...")
 			conn.output[0] <- frame
@@ -1053,6 +1430,11 @@ func (conn *connV2) processFrame(frame Frame) bool {
 			}
 		}
 		conn.goawayReceived = true
+		conn.setError(&ConnectionError{
+			GoawayStatus:     GOAWAY_OK,
+			LastGoodStreamID: frame.LastGoodStreamID,
+			Cause:            ErrGoaway,
+		})
 
 	case *headersFrameV2:
 		conn.handleHeaders(frame)
@@ -1090,6 +1472,7 @@ func (conn *connV2) readFrames() {
 
 		// ReadFrame takes care of the frame parsing for us.
 		conn.refreshReadTimeout()
+		start := bytesRead(conn.buf, conn.counter)
 		frame, err := readFrameV2(conn.buf)
 		if err != nil {
 			conn.handleReadWriteError(err)
@@ -1099,6 +1482,10 @@ func (conn *connV2) readFrames() {
 		// Print frame type.
 		debug.Printf("Receiving %s:\n", frame.Name())
 
+		// Measure the frame before its headers are decompressed.
+		size := bytesRead(conn.buf, conn.counter) - start
+		compressed, _, hasHeader := headerSizes(frame)
+
 		// Decompress the frame's headers, if there are any.
 		err = frame.Decompress(conn.decompressor)
 		if err != nil {
@@ -1107,9 +1494,22 @@ func (conn *connV2) readFrames() {
 			return
 		}
 
+		conn.stats.frameReceived(frame, size)
+		if hasHeader {
+			_, uncompressed, _ := headerSizes(frame)
+			conn.stats.headersReceived(uncompressed, compressed)
+		}
+
 		// Print frame once the content's been decompressed.
 		debug.Println(frame)
 
+		// Record the frame if the session is being captured.
+		if capture := conn.captureWriter(); capture != nil {
+			if err := capture.WriteFrame(true, frame); err != nil {
+				log.Println("Error in capture: ", err)
+			}
+		}
+
 		// This is the main frame handling.
 		if conn.processFrame(frame) {
 			return
@@ -1165,11 +1565,23 @@ func (conn *connV2) send() {
 		// Leave the specifics of writing to the
 		// connection up to the frame.
 		conn.refreshWriteTimeout()
-		_, err = frame.WriteTo(conn.conn)
+		n, err := frame.WriteTo(conn.conn)
 		if err != nil {
 			conn.handleReadWriteError(err)
 			return
 		}
+
+		conn.stats.frameSent(frame, n)
+		if compressed, uncompressed, ok := headerSizes(frame); ok {
+			conn.stats.headersSent(uncompressed, compressed)
+		}
+
+		// Record the frame if the session is being captured.
+		if capture := conn.captureWriter(); capture != nil {
+			if err := capture.WriteFrame(false, frame); err != nil {
+				log.Println("Error in capture: ", err)
+			}
+		}
 	}
 }
 
@@ -1213,7 +1625,7 @@ func (conn *connV2) selectFrameToSend(prioritise bool) (frame Frame) {
 		return frame
 	case frame = <-conn.output[2]:
 		return frame
-	case frame = <-conn.output[2]:
+	case frame = <-conn.output[3]:
 		return frame
 	case frame = <-conn.output[4]:
 		return frame
@@ -1228,6 +1640,12 @@ func (conn *connV2) selectFrameToSend(prioritise bool) (frame Frame) {
 	}
 }
 
+// reprioritise returns the output channel a
+// stream's frames should use at the new priority.
+func (conn *connV2) reprioritise(sid StreamID, priority Priority) chan<- Frame {
+	return conn.output[priority]
+}
+
 // Add timeouts if requested by the server.
 func (conn *connV2) refreshTimeouts() {
 	if d := conn.readTimeout; d != 0 && conn.conn != nil {
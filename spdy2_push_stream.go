@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // pushStreamV2 is a structure that implements the
@@ -22,8 +23,11 @@ type pushStreamV2 struct {
 	origin   Stream
 	state    *StreamState
 	output   chan<- Frame
+	priority Priority
 	header   http.Header
 	stop     <-chan bool
+
+	writeDeadline deadline
 }
 
 /***********************
@@ -36,12 +40,17 @@ func (p *pushStreamV2) Header() http.Header {
 
 // Write is used for sending data in the push.
 func (p *pushStreamV2) Write(inputData []byte) (int, error) {
+	if err := p.writeDeadline.err(); err != nil {
+		return 0, err
+	}
+
 	if p.closed() || p.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, &StreamError{ID: p.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
 	}
 
-	state := p.origin.State()
-	if p.origin == nil || state.ClosedHere() {
+	// Once its SYN_STREAM has been sent, a push may
+	// continue after the origin stream has closed.
+	if p.origin == nil {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
@@ -75,8 +84,9 @@ func (p *pushStreamV2) Write(inputData []byte) (int, error) {
 	return written + n, nil
 }
 
-// WriteHeader is provided to satisfy the Stream
-// interface, but has no effect.
+// WriteHeader sends any headers set so far. In
+// SPDY/2, the pushed response's status is sent
+// in the SYN_STREAM, so it cannot be changed.
 func (p *pushStreamV2) WriteHeader(int) {
 	p.writeHeader()
 	return
@@ -90,6 +100,7 @@ func (p *pushStreamV2) Close() error {
 	p.Lock()
 	defer p.Unlock()
 	p.writeHeader()
+	p.writeDeadline.stop()
 	if p.state != nil {
 		p.state.Close()
 	}
@@ -140,6 +151,55 @@ func (p *pushStreamV2) Run() error {
 	return nil
 }
 
+// Priority returns the stream's current priority.
+func (p *pushStreamV2) Priority() Priority {
+	p.Lock()
+	defer p.Unlock()
+	return p.priority
+}
+
+// SetPriority changes the priority of the frames the
+// stream sends from now on. Frames already handed to the
+// connection keep their original priority.
+func (p *pushStreamV2) SetPriority(priority Priority) error {
+	if !priority.Valid(2) {
+		return errors.New("Error: Priority must be in the range 0 - 3.")
+	}
+
+	conn, ok := p.conn.(*connV2)
+	if !ok || p.closed() {
+		return &StreamError{ID: p.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.priority = priority
+	p.output = conn.reprioritise(p.streamID, priority)
+	return nil
+}
+
+// SetReadDeadline is provided to satisfy the Stream
+// interface, but has no effect, as pushes receive no data.
+func (p *pushStreamV2) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets the time by which the push must
+// have been sent. If the push is unfinished when the
+// deadline passes, it is reset with RST_STREAM_CANCEL.
+// Writes after the deadline fail with os.ErrDeadlineExceeded.
+// A zero time removes the deadline.
+func (p *pushStreamV2) SetWriteDeadline(t time.Time) error {
+	if p.closed() {
+		return &StreamError{ID: p.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	p.writeDeadline.set(t, func() {
+		p.reset(RST_STREAM_CANCEL)
+	})
+	return nil
+}
+
 func (p *pushStreamV2) State() *StreamState {
 	return p.state
 }
@@ -153,6 +213,10 @@ func (p *pushStreamV2) StreamID() StreamID {
  **************/
 
 func (p *pushStreamV2) Finish() {
+	if p.closed() || p.state.ClosedHere() {
+		return
+	}
+
 	p.writeHeader()
 	end := new(dataFrameV2)
 	end.StreamID = p.streamID
@@ -166,6 +230,25 @@ func (p *pushStreamV2) Finish() {
  * Others *
  **********/
 
+// reset ends the push early by sending RST_STREAM
+// with the given status, and closing the stream.
+func (p *pushStreamV2) reset(status StatusCode) {
+	p.Lock()
+	if p.closed() || p.state.ClosedHere() {
+		p.Unlock()
+		return
+	}
+
+	rst := new(rstStreamFrameV2)
+	rst.StreamID = p.streamID
+	rst.Status = status
+	p.output <- rst
+	p.state.Close()
+	p.Unlock()
+
+	p.Close()
+}
+
 func (p *pushStreamV2) closed() bool {
 	if p.conn == nil || p.state == nil {
 		return true
@@ -181,7 +264,7 @@ func (p *pushStreamV2) closed() bool {
 // writeHeader is used to send HTTP headers to
 // the client.
 func (p *pushStreamV2) writeHeader() {
-	if len(p.header) == 0 || p.closed() {
+	if len(p.header) == 0 || p.closed() || p.state.ClosedHere() {
 		return
 	}
 
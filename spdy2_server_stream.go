@@ -5,13 +5,15 @@
 package spdy
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"runtime"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // serverStreamV2 is a structure that implements the
@@ -21,7 +23,7 @@ type serverStreamV2 struct {
 	sync.Mutex
 	conn           Conn
 	streamID       StreamID
-	requestBody    *bytes.Buffer
+	requestBody    *bodyBuffer
 	state          *StreamState
 	output         chan<- Frame
 	request        *http.Request
@@ -29,10 +31,20 @@ type serverStreamV2 struct {
 	header         http.Header
 	unidirectional bool
 	responseCode   int
-	ready          chan struct{}
 	stop           chan bool
 	wroteHeader    bool
 	priority       Priority
+	cancel         context.CancelFunc
+	closeNotify    chan bool
+	readDeadline   deadline
+	writeDeadline  deadline
+	timeout        time.Duration
+	timeoutStatus  StatusCode
+	trailers       []string
+	pushPreload    bool
+	pushPolicy     *PushPolicy
+	pushHistory    *pushHistory
+	written        int64
 }
 
 /***********************
@@ -49,13 +61,18 @@ func (s *serverStreamV2) Write(inputData []byte) (int, error) {
 		return 0, errors.New("Error: Stream is unidirectional.")
 	}
 
+	if err := s.writeDeadline.err(); err != nil {
+		return 0, err
+	}
+
 	if s.closed() || s.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
 	}
 
 	// Copy the data locally to avoid any pointer issues.
 	data := make([]byte, len(inputData))
 	copy(data, inputData)
+	s.written += int64(len(data))
 
 	// Default to 200 response.
 	if !s.wroteHeader {
@@ -101,6 +118,16 @@ func (s *serverStreamV2) WriteHeader(code int) {
 		return
 	}
 
+	if s.state.ClosedHere() {
+		log.Println("Error: Stream already closed.")
+		return
+	}
+
+	// Push any preloaded resources before
+	// the response is sent.
+	s.pushPreloads()
+	s.pushLearned()
+
 	s.wroteHeader = true
 	s.responseCode = code
 	s.header.Set("status", strconv.Itoa(code))
@@ -111,8 +138,14 @@ func (s *serverStreamV2) WriteHeader(code int) {
 	synReply.StreamID = s.streamID
 	synReply.Header = cloneHeader(s.header)
 
-	// Clear the headers that have been sent.
+	// Clear the headers that have been sent,
+	// keeping any trailers until the end.
+	s.trailers = declaredTrailers(s.header)
 	for name := range synReply.Header {
+		if isTrailer(name, s.trailers) {
+			synReply.Header.Del(name)
+			continue
+		}
 		s.header.Del(name)
 	}
 
@@ -125,6 +158,38 @@ func (s *serverStreamV2) WriteHeader(code int) {
 	s.output <- synReply
 }
 
+/****************
+ * http.Flusher *
+ ****************/
+
+// Flush implements http.Flusher, sending the response
+// headers if they have not yet been sent. Data written
+// to the stream is sent immediately, subject to flow
+// control, so there is nothing else to flush.
+func (s *serverStreamV2) Flush() {
+	if !s.unidirectional && !s.wroteHeader && s.state.OpenHere() {
+		s.WriteHeader(http.StatusOK)
+	}
+}
+
+/***************
+ * http.Pusher *
+ ***************/
+
+// Push implements http.Pusher, pushing target to the client
+// and serving it with the server's Handler, as though the
+// client had requested it. The target may be an absolute
+// path, which is resolved against the request's host.
+func (s *serverStreamV2) Push(target string, opts *http.PushOptions) error {
+	if s.unidirectional {
+		return http.ErrNotSupported
+	}
+	if conn, ok := s.conn.(*connV2); ok && conn.pushStreamLimit.Limit() == 0 {
+		return http.ErrNotSupported
+	}
+	return servePush(s, s.request, s.handler, target, opts)
+}
+
 /*****************
  * io.ReadCloser *
  *****************/
@@ -133,12 +198,14 @@ func (s *serverStreamV2) Close() error {
 	s.Lock()
 	defer s.Unlock()
 	s.writeHeader()
+	s.cancelRequest()
+	s.readDeadline.stop()
+	s.writeDeadline.stop()
 	if s.state != nil {
 		s.state.Close()
 	}
 	if s.requestBody != nil {
-		s.requestBody.Reset()
-		s.requestBody = nil
+		s.requestBody.finish(io.ErrUnexpectedEOF)
 	}
 	s.output = nil
 	s.request = nil
@@ -149,9 +216,15 @@ func (s *serverStreamV2) Close() error {
 }
 
 func (s *serverStreamV2) Read(out []byte) (int, error) {
+	if err := s.readDeadline.err(); err != nil {
+		return 0, err
+	}
 	n, err := s.requestBody.Read(out)
-	if err == io.EOF && s.state.OpenThere() {
-		return n, nil
+	if err != nil && err != io.EOF {
+		// Report a deadline which reset the stream.
+		if deadline := s.readDeadline.err(); deadline != nil {
+			return n, deadline
+		}
 	}
 	return n, err
 }
@@ -177,22 +250,14 @@ func (s *serverStreamV2) ReceiveFrame(frame Frame) error {
 	case *dataFrameV2:
 		s.requestBody.Write(frame.Data)
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.finish(nil)
 			s.state.CloseThere()
 		}
 
 	case *synReplyFrameV2:
 		updateHeader(s.header, frame.Header)
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.finish(nil)
 			s.state.CloseThere()
 		}
 
@@ -209,8 +274,10 @@ func (s *serverStreamV2) ReceiveFrame(frame Frame) error {
 	return nil
 }
 
+// CloseNotify returns a channel which is closed when the
+// stream is reset or closed, or its connection ends.
 func (s *serverStreamV2) CloseNotify() <-chan bool {
-	return s.stop
+	return s.closeNotify
 }
 
 // run is the main control path of
@@ -222,34 +289,65 @@ func (s *serverStreamV2) Run() error {
 	// Catch any panics.
 	defer func() {
 		if v := recover(); v != nil {
-			if s != nil && s.state != nil && !s.state.Closed() {
-				log.Println("Encountered stream error:", v)
-			}
+			s.handlePanic(v)
 		}
 	}()
 
 	// Make sure Request is prepared.
-	if s.requestBody == nil || s.request.Body == nil {
-		s.requestBody = new(bytes.Buffer)
-		s.request.Body = &readCloser{s.requestBody}
+	if s.requestBody == nil {
+		s.requestBody = newBodyBuffer()
+		if s.state.ClosedThere() {
+			s.requestBody.finish(nil)
+		}
+	}
+	if s.request.Body == nil {
+		s.request.Body = s.requestBody
+	}
+
+	// Bound the time taken to receive the request and
+	// run the handler, if the server has a timeout.
+	if s.timeout > 0 {
+		timer := time.AfterFunc(s.timeout, func() {
+			s.reset(s.timeoutStatus)
+		})
+		defer timer.Stop()
 	}
 
-	// Wait until the full request has been received.
-	<-s.ready
+	// The handler is run as soon as the request
+	// headers have been received, so that the
+	// response can be sent while the request
+	// body is still arriving.
+	select {
+	case <-s.closeNotify:
+		return nil
+	default:
+	}
+
+	// Learn from the request, if the
+	// server has a push policy.
+	if s.pushPolicy != nil {
+		s.pushPolicy.observe(s.pushHistory, s.request)
+	}
 
 	/***************
 	 *** HANDLER ***
 	 ***************/
 	s.handler.ServeHTTP(s, s.request)
 
+	// The request is over, so cancel its context.
+	s.cancel()
+
 	// Close the stream with a SYN_REPLY if
-	// none has been sent, or an empty DATA
-	// frame, if a SYN_REPLY has been sent
-	// already.
+	// none has been sent, a HEADERS frame
+	// if there are trailers, or an empty
+	// DATA frame otherwise.
 	// If the stream is already closed at
 	// this end, then nothing happens.
 	if !s.unidirectional {
-		if s.state.OpenHere() && !s.wroteHeader {
+		if s.state.OpenHere() && !s.wroteHeader && !hasTrailer(s.header) {
+			s.pushPreloads()
+			s.pushLearned()
+
 			s.header.Set("status", "200")
 			s.header.Set("version", "HTTP/1.1")
 
@@ -261,21 +359,132 @@ func (s *serverStreamV2) Run() error {
 
 			s.output <- synReply
 		} else if s.state.OpenHere() {
-			// Create the DATA.
-			data := new(dataFrameV2)
-			data.StreamID = s.streamID
-			data.Flags = FLAG_FIN
-			data.Data = []byte{}
+			if !s.wroteHeader {
+				s.WriteHeader(http.StatusOK)
+			}
 
-			s.output <- data
+			if trailer := takeTrailer(s.header, s.trailers); len(trailer) > 0 && s.state.OpenHere() {
+				// Send the trailers in a final HEADERS.
+				header := new(headersFrameV2)
+				header.Flags = FLAG_FIN
+				header.StreamID = s.streamID
+				header.Header = trailer
+
+				s.output <- header
+			} else if s.state.OpenHere() {
+				// Create the DATA.
+				data := new(dataFrameV2)
+				data.StreamID = s.streamID
+				data.Flags = FLAG_FIN
+				data.Data = []byte{}
+
+				s.output <- data
+			}
 		}
 	}
 
+	// Record the size of the response
+	// for the push policy's budget.
+	if s.pushPolicy != nil && (s.responseCode == 0 || s.responseCode == http.StatusOK) {
+		s.pushPolicy.observeSize(s.request, s.written)
+	}
+
 	// Clean up state.
 	s.state.CloseHere()
 	return nil
 }
 
+// Priority returns the stream's current priority.
+func (s *serverStreamV2) Priority() Priority {
+	s.Lock()
+	defer s.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority of the frames the
+// stream sends from now on. Frames already handed to the
+// connection keep their original priority.
+func (s *serverStreamV2) SetPriority(priority Priority) error {
+	if !priority.Valid(2) {
+		return errors.New("Error: Priority must be in the range 0 - 3.")
+	}
+
+	conn, ok := s.conn.(*connV2)
+	if !ok || s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.priority = priority
+	s.output = conn.reprioritise(s.streamID, priority)
+	return nil
+}
+
+// SetReadDeadline sets the time by which the request
+// must have been received. If the client is still sending
+// when the deadline passes, the stream is reset with
+// RST_STREAM_CANCEL. Reads after the deadline fail with
+// os.ErrDeadlineExceeded. A zero time removes the deadline.
+func (s *serverStreamV2) SetReadDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.readDeadline.set(t, func() {
+		if s.state.OpenThere() {
+			s.reset(RST_STREAM_CANCEL)
+		}
+	})
+	return nil
+}
+
+// SetWriteDeadline sets the time by which the response
+// must have been sent. If the response is unfinished when
+// the deadline passes, the stream is reset with
+// RST_STREAM_CANCEL. Writes after the deadline fail with
+// os.ErrDeadlineExceeded. A zero time removes the deadline.
+func (s *serverStreamV2) SetWriteDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.writeDeadline.set(t, func() {
+		if s.state.OpenHere() {
+			s.reset(RST_STREAM_CANCEL)
+		}
+	})
+	return nil
+}
+
+// reset ends the stream early by sending RST_STREAM
+// with the given status, and closing the stream so that
+// any later writes fail.
+func (s *serverStreamV2) reset(status StatusCode) error {
+	if status < RST_STREAM_PROTOCOL_ERROR || status > RST_STREAM_FLOW_CONTROL_ERROR {
+		return errors.New("Error: Invalid RST_STREAM status.")
+	}
+
+	if s.closed() || s.state.Closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	rst := new(rstStreamFrameV2)
+	rst.StreamID = s.streamID
+	rst.Status = status
+	s.output <- rst
+
+	s.state.Close()
+	s.cancelRequest()
+	if s.requestBody != nil {
+		s.requestBody.finish(&StreamError{ID: s.streamID, Status: status})
+	}
+	return nil
+}
+
 func (s *serverStreamV2) State() *StreamState {
 	return s.state
 }
@@ -284,6 +493,90 @@ func (s *serverStreamV2) StreamID() StreamID {
 	return s.streamID
 }
 
+// handlePanic recovers the stream after its handler has
+// panicked. The panic is logged, unless it is
+// http.ErrAbortHandler, and the client is sent a 500
+// response if no response has been started, or
+// RST_STREAM_INTERNAL_ERROR otherwise.
+func (s *serverStreamV2) handlePanic(v interface{}) {
+	if s.state == nil || s.state.Closed() {
+		return
+	}
+
+	if v != http.ErrAbortHandler {
+		const size = 64 << 10
+		buf := make([]byte, size)
+		buf = buf[:runtime.Stack(buf, false)]
+		log.Printf("panic serving stream %d: %v\n%s", s.streamID, v, buf)
+	}
+
+	if s.wroteHeader || s.unidirectional || v == http.ErrAbortHandler || s.state.ClosedHere() {
+		s.reset(RST_STREAM_INTERNAL_ERROR)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Discard any headers set by the handler.
+	synReply := new(synReplyFrameV2)
+	synReply.Flags = FLAG_FIN
+	synReply.StreamID = s.streamID
+	synReply.Header = make(http.Header)
+	synReply.Header.Set("status", strconv.Itoa(http.StatusInternalServerError))
+	synReply.Header.Set("version", "HTTP/1.1")
+
+	s.wroteHeader = true
+	s.responseCode = http.StatusInternalServerError
+	s.output <- synReply
+	s.state.CloseHere()
+	s.cancelRequest()
+}
+
+// pushPreloads pushes the same-origin resources named in
+// the response's Link: rel=preload headers, if the server
+// is configured to do so.
+func (s *serverStreamV2) pushPreloads() {
+	if !s.pushPreload {
+		return
+	}
+
+	for _, target := range preloadTargets(s.header, s.request) {
+		if err := s.Push(target, nil); err != nil {
+			debug.Printf("Note: Failed to push %s: %v\n", target, err)
+		}
+	}
+}
+
+// pushLearned pushes the resources which the server's
+// push policy expects to be fetched after this request.
+func (s *serverStreamV2) pushLearned() {
+	if s.pushPolicy == nil {
+		return
+	}
+
+	for _, target := range s.pushPolicy.pushes(s.pushHistory, s.request) {
+		if err := s.Push(target, nil); err != nil {
+			debug.Printf("Note: Failed to push %s: %v\n", target, err)
+			continue
+		}
+		s.pushPolicy.pushed(s.pushHistory, s.request, target)
+	}
+}
+
+// cancelRequest cancels the request's context and
+// fires CloseNotify. The stream must be locked.
+func (s *serverStreamV2) cancelRequest() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	select {
+	case <-s.closeNotify:
+	default:
+		close(s.closeNotify)
+	}
+}
+
 func (s *serverStreamV2) closed() bool {
 	if s.conn == nil || s.state == nil || s.handler == nil {
 		return true
@@ -298,7 +591,7 @@ func (s *serverStreamV2) closed() bool {
 
 // writeHeader is used to flush HTTP headers.
 func (s *serverStreamV2) writeHeader() {
-	if len(s.header) == 0 || s.unidirectional {
+	if len(s.header) == 0 || s.unidirectional || (s.state != nil && s.state.ClosedHere()) {
 		return
 	}
 
@@ -307,10 +600,18 @@ func (s *serverStreamV2) writeHeader() {
 	header.StreamID = s.streamID
 	header.Header = cloneHeader(s.header)
 
-	// Clear the headers that have been sent.
+	// Clear the headers that have been sent,
+	// keeping any trailers until the end.
 	for name := range header.Header {
+		if isTrailer(name, s.trailers) {
+			header.Header.Del(name)
+			continue
+		}
 		s.header.Del(name)
 	}
+	if len(header.Header) == 0 {
+		return
+	}
 
 	s.output <- header
 }
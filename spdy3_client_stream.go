@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 )
 
 // clientStreamV3 is a structure that implements
@@ -22,12 +24,18 @@ type clientStreamV3 struct {
 	flow         *flowControl
 	state        *StreamState
 	output       chan<- Frame
+	priority     Priority
 	request      *http.Request
 	receiver     Receiver
 	header       http.Header
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
+	err          error
+	delivered    chan struct{}
+
+	readDeadline  deadline
+	writeDeadline deadline
 }
 
 /***********************
@@ -40,8 +48,12 @@ func (s *clientStreamV3) Header() http.Header {
 
 // Write is one method with which request data is sent.
 func (s *clientStreamV3) Write(inputData []byte) (int, error) {
+	if err := s.writeDeadline.err(); err != nil {
+		return 0, err
+	}
+
 	if s.closed() || s.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
 	}
 
 	// Copy the data locally to avoid any pointer issues.
@@ -89,8 +101,10 @@ func (s *clientStreamV3) Close() error {
 	s.Lock()
 	defer s.Unlock()
 	s.writeHeader()
+	s.readDeadline.stop()
+	s.writeDeadline.stop()
 	if s.state != nil {
-		if s.state.OpenThere() {
+		if !s.state.Closed() {
 			// Send the RST_STREAM.
 			rst := new(rstStreamFrameV3)
 			rst.StreamID = s.streamID
@@ -138,6 +152,13 @@ func (s *clientStreamV3) ReceiveFrame(frame Frame) error {
 		return errors.New("Nil frame received.")
 	}
 
+	// The frames are delivered after the stream
+	// may have been closed.
+	receiver, request := s.receiver, s.request
+	if receiver == nil {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *dataFrameV3:
@@ -150,34 +171,31 @@ func (s *clientStreamV3) ReceiveFrame(frame Frame) error {
 
 		// Give to the client.
 		s.flow.Receive(frame.Data)
-		go func() {
-			s.receiver.ReceiveData(s.request, data, frame.Flags.FIN())
+		s.deliver(func() {
+			receiver.ReceiveData(request, data, frame.Flags.FIN())
 
 			if frame.Flags.FIN() {
-				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}()
+		})
 
 	case *synReplyFrameV3:
-		go func() {
-			s.receiver.ReceiveHeader(s.request, frame.Header)
+		s.deliver(func() {
+			receiver.ReceiveHeader(request, frame.Header)
 
 			if frame.Flags.FIN() {
-				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}()
+		})
 
 	case *headersFrameV3:
-		go func() {
-			s.receiver.ReceiveHeader(s.request, frame.Header)
+		s.deliver(func() {
+			receiver.ReceiveHeader(request, frame.Header)
 
 			if frame.Flags.FIN() {
-				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}()
+		})
 
 	case *windowUpdateFrameV3:
 		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
@@ -195,6 +213,24 @@ func (s *clientStreamV3) ReceiveFrame(frame Frame) error {
 	return nil
 }
 
+// deliver passes a received frame to the receiver with f,
+// in a new goroutine so that the connection is not held up.
+// Each frame is only delivered once the previous frame has
+// been, so that the receiver sees them in order. The stream's
+// recvMutex must be held.
+func (s *clientStreamV3) deliver(f func()) {
+	previous := s.delivered
+	done := make(chan struct{})
+	s.delivered = done
+	go func() {
+		if previous != nil {
+			<-previous
+		}
+		f()
+		close(done)
+	}()
+}
+
 func (s *clientStreamV3) CloseNotify() <-chan bool {
 	return s.stop
 }
@@ -204,8 +240,11 @@ func (s *clientStreamV3) CloseNotify() <-chan bool {
 // processed, and then the stream
 // is cleaned up and closed.
 func (s *clientStreamV3) Run() error {
-	// Receive and process inbound frames.
-	<-s.finished
+	// Receive and process inbound frames,
+	// reporting a reset by the server.
+	if err := s.wait(); err != nil {
+		return err
+	}
 
 	// Make sure any queued data has been sent.
 	if s.flow.Paused() {
@@ -217,6 +256,72 @@ func (s *clientStreamV3) Run() error {
 	return nil
 }
 
+// Priority returns the stream's current priority.
+func (s *clientStreamV3) Priority() Priority {
+	s.Lock()
+	defer s.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority of the frames the
+// stream sends from now on, including any data held back
+// by flow control. Frames already handed to the connection
+// keep their original priority.
+func (s *clientStreamV3) SetPriority(priority Priority) error {
+	if !priority.Valid(3) {
+		return errors.New("Error: Priority must be in the range 0 - 7.")
+	}
+
+	conn, ok := s.conn.(*connV3)
+	if !ok || s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.priority = priority
+	s.output = conn.reprioritise(s.streamID, priority, s.flow)
+	return nil
+}
+
+// SetReadDeadline sets the time by which the response
+// must have been received. If the server is still sending
+// when the deadline passes, the stream is cancelled with
+// RST_STREAM_CANCEL, and Run returns os.ErrDeadlineExceeded.
+// A zero time removes the deadline.
+func (s *clientStreamV3) SetReadDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.readDeadline.set(t, func() {
+		if s.state.OpenThere() {
+			s.deadlineExceeded()
+		}
+	})
+	return nil
+}
+
+// SetWriteDeadline sets the time by which the request
+// must have been sent. If the request is unfinished when
+// the deadline passes, the stream is cancelled with
+// RST_STREAM_CANCEL, and Run returns os.ErrDeadlineExceeded.
+// Writes after the deadline also fail with
+// os.ErrDeadlineExceeded. A zero time removes the deadline.
+func (s *clientStreamV3) SetWriteDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.writeDeadline.set(t, func() {
+		if s.state.OpenHere() {
+			s.deadlineExceeded()
+		}
+		s.flow.wake()
+	})
+	return nil
+}
+
 func (s *clientStreamV3) State() *StreamState {
 	return s.state
 }
@@ -225,6 +330,98 @@ func (s *clientStreamV3) StreamID() StreamID {
 	return s.streamID
 }
 
+// resetByPeer closes the stream after the server has
+// reset it with RST_STREAM, recording the status so that
+// Run can report it.
+func (s *clientStreamV3) resetByPeer(status StatusCode) {
+	s.Lock()
+	if s.err == nil {
+		s.err = &StreamError{ID: s.streamID, Status: status}
+	}
+	if s.state != nil {
+		s.state.Close()
+	}
+	s.Unlock()
+	s.Close()
+}
+
+// deadlineExceeded cancels the stream once one of its
+// deadlines has passed, so that Run reports the error.
+func (s *clientStreamV3) deadlineExceeded() {
+	s.Lock()
+	if s.err == nil {
+		s.err = os.ErrDeadlineExceeded
+	}
+	s.Unlock()
+	s.Close()
+}
+
+// closeWrite finishes the request body with an empty
+// DATA frame carrying FIN, once any data held back by
+// flow control has been sent.
+func (s *clientStreamV3) closeWrite() error {
+	if s.closed() || s.state.ClosedHere() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+
+	// Wait for the buffered data to be sent,
+	// as the transfer window grows.
+	for {
+		wait := s.flow.Wait()
+		if !s.flow.Paused() {
+			break
+		}
+		if err := s.writeDeadline.err(); err != nil {
+			return err
+		}
+		if s.closed() || s.state.ClosedHere() {
+			return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+		}
+		select {
+		case <-wait:
+		case <-s.stop:
+		}
+	}
+
+	data := new(dataFrameV3)
+	data.StreamID = s.streamID
+	data.Flags = FLAG_FIN
+	data.Data = []byte{}
+	s.output <- data
+
+	s.state.CloseHere()
+	return nil
+}
+
+// finish marks the response as having been
+// received in full.
+func (s *clientStreamV3) finish() {
+	s.Lock()
+	defer s.Unlock()
+	if s.state != nil {
+		s.state.CloseThere()
+	}
+	select {
+	case <-s.finished:
+	default:
+		close(s.finished)
+	}
+}
+
+// wait blocks until the response has been
+// received, or the stream has been closed,
+// and returns the reason for any reset.
+func (s *clientStreamV3) wait() error {
+	<-s.finished
+
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
 func (s *clientStreamV3) closed() bool {
 	if s.conn == nil || s.state == nil || s.receiver == nil {
 		return true
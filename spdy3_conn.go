@@ -7,6 +7,7 @@ package spdy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -15,8 +16,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,10 +32,12 @@ type connV3 struct {
 	server              *http.Server
 	conn                net.Conn
 	buf                 *bufio.Reader
+	counter             *countingReader // counts the bytes read into buf.
 	tlsState            *tls.ConnectionState
 	streams             map[StreamID]Stream            // map of active streams.
 	output              [8]chan Frame                  // one output channel per priority level.
-	pings               map[uint32]chan<- Ping         // response channel for pings.
+	pings               map[uint32]chan time.Duration  // response channel for pings, given the round-trip time.
+	pingSent            map[uint32]time.Time           // time each outbound ping was sent.
 	nextPingID          uint32                         // next outbound ping ID.
 	compressor          Compressor                     // outbound compression state.
 	decompressor        Decompressor                   // inbound decompression state.
@@ -40,7 +45,7 @@ type connV3 struct {
 	lastPushStreamID    StreamID                       // last push stream ID. (even)
 	lastRequestStreamID StreamID                       // last request stream ID. (odd)
 	oddity              StreamID                       // whether locally-sent streams are odd or even.
-	initialWindowSize   uint32                         // initial transport window.
+	initialWindowSize   uint32                         // initial transport window, stored atomically.
 	goawayReceived      bool                           // goaway has been received.
 	goawaySent          bool                           // goaway has been sent.
 	numBenignErrors     int                            // number of non-serious errors encountered.
@@ -50,6 +55,8 @@ type connV3 struct {
 	certificates        map[uint16][]*x509.Certificate // certificates received in CREDENTIAL frames and TLS handshake.
 	pushRequests        map[StreamID]*http.Request     // map of requests sent in server pushes.
 	pushReceiver        Receiver                       // Receiver to call for server Pushes.
+	accepted            chan *rawStreamV3              // raw streams opened by the other endpoint, awaiting Accept.
+	rawStreams          bool                           // whether raw streams from the other endpoint are accepted.
 	stop                chan bool                      // this channel is closed when the connection closes.
 	sending             chan struct{}                  // this channel is used to ensure pending frames are sent.
 	init                func()                         // this function is called before the connection begins.
@@ -57,13 +64,28 @@ type connV3 struct {
 	writeTimeout        time.Duration                  // optional timeout for network writes.
 	flowControl         FlowControl                    // flow control module.
 	pushedResources     map[Stream]map[string]struct{} // used to prevent duplicate headers being pushed.
+	capture             atomic.Value                   // optional *CaptureWriter recording the frames sent and received.
+	priorities          map[StreamID]Priority          // current priority of each stream, guarded by priorityLock.
+	priorityLock        sync.Mutex                     // used to access priorities from the send loop.
+	stats               *connStats                     // statistics for this connection.
+	keepAliveStop       chan struct{}                  // this channel is closed to stop the keepalive.
+	idleStop            chan struct{}                  // this channel is closed to stop the idle timeout.
+	lastActive          time.Time                      // last time a stream was seen to be active.
+	requestTimeout      time.Duration                  // maximum time to receive and handle each request.
+	timeoutStatus       StatusCode                     // RST_STREAM status sent when requestTimeout is exceeded.
+	pushPreload         bool                           // push resources named in Link: rel=preload headers.
+	pushPolicy          *PushPolicy                    // learns which resources to push.
+	pushHistory         *pushHistory                   // pages and resources sent, for pushPolicy.
+	streamLock          sync.Mutex                     // serialises the sending of locally-opened streams.
+	err                 error                          // reason the connection ended, returned by Run.
 
 	// SPDY/3.1
-	subversion                int            // SPDY 3 subversion (eg 0 for SPDY/3, 1 for SPDY/3.1).
-	dataBuffer                []*dataFrameV3 // used to store frames witheld for flow control.
+	subversion                int     // SPDY 3 subversion (eg 0 for SPDY/3, 1 for SPDY/3.1).
+	dataBuffer                []Frame // used to store frames witheld for flow control.
 	connectionWindowSize      int64
 	initialWindowSizeThere    uint32
 	connectionWindowSizeThere int64
+	windowGrown               chan struct{} // signals the send loop when the connection window grows.
 }
 
 // Close ends the connection, cleaning up relevant resources.
@@ -111,9 +133,11 @@ func (conn *connV3) Close() (err error) {
 		close(conn.stop)
 	}
 
+	// The connection, compressor and decompressor are
+	// left in place, as the send and receive loops may
+	// still be using them.
 	if conn.conn != nil {
 		conn.conn.Close()
-		conn.conn = nil
 	}
 
 	for _, stream := range conn.streams {
@@ -126,9 +150,7 @@ func (conn *connV3) Close() (err error) {
 
 	if conn.compressor != nil {
 		conn.compressor.Close()
-		conn.compressor = nil
 	}
-	conn.decompressor = nil
 
 	conn.pushedResources = nil
 
@@ -157,17 +179,18 @@ func (c *connV3) Conn() net.Conn {
 // InitialWindowSize gives the most recently-received value for
 // the INITIAL_WINDOW_SIZE setting.
 func (conn *connV3) InitialWindowSize() (uint32, error) {
-	return conn.initialWindowSize, nil
+	return atomic.LoadUint32(&conn.initialWindowSize), nil
 }
 
-// Ping is used by spdy.PingServer and spdy.PingClient to send
-// SPDY PINGs.
-func (conn *connV3) Ping() (<-chan Ping, error) {
+// Ping sends a SPDY PING and waits for the response, returning
+// the round-trip time. If ctx is done before the response is
+// received, Ping gives up and returns ctx.Err().
+func (conn *connV3) Ping(ctx context.Context) (time.Duration, error) {
 	conn.Lock()
-	defer conn.Unlock()
 
 	if conn.closed() {
-		return nil, errors.New("Error: Conn has been closed.")
+		conn.Unlock()
+		return 0, ErrConnClosed
 	}
 
 	ping := new(pingFrameV3)
@@ -182,24 +205,78 @@ func (conn *connV3) Ping() (<-chan Ping, error) {
 		conn.nextPingID += 2
 	}
 	ping.PingID = pid
-	conn.output[0] <- ping
-	c := make(chan Ping, 1)
+	c := make(chan time.Duration, 1)
 	conn.pings[pid] = c
+	conn.pingSent[pid] = time.Now()
+	conn.Unlock()
+
+	// The lock is not held while sending, as
+	// the send loop may already have stopped.
+	select {
+	case conn.output[0] <- ping:
+	case <-conn.stop:
+		conn.forgetPing(pid)
+		return 0, ErrConnClosed
+	case <-ctx.Done():
+		conn.forgetPing(pid)
+		return 0, ctx.Err()
+	}
+
+	select {
+	case rtt := <-c:
+		return rtt, nil
+	case <-conn.stop:
+		conn.forgetPing(pid)
+		return 0, ErrConnClosed
+	case <-ctx.Done():
+		conn.forgetPing(pid)
+		return 0, ctx.Err()
+	}
+}
 
-	return c, nil
+// forgetPing discards a PING which is no
+// longer awaited.
+func (conn *connV3) forgetPing(pid uint32) {
+	conn.Lock()
+	delete(conn.pings, pid)
+	delete(conn.pingSent, pid)
+	conn.Unlock()
 }
 
 // Push is used to issue a server push to the client. Note that this cannot be performed
 // by clients.
 func (conn *connV3) Push(resource string, origin Stream) (PushStream, error) {
+	return conn.PushWithOptions(resource, origin, nil)
+}
+
+// PushWithOptions is used to issue a server push to the client, as described by opts.
+// Note that this cannot be performed by clients.
+func (conn *connV3) PushWithOptions(resource string, origin Stream, opts *PushOptions) (PushStream, error) {
 	if conn.goawayReceived || conn.goawaySent {
 		return nil, ErrGoaway
 	}
 
 	if conn.server == nil {
-		return nil, errors.New("Error: Only servers can send pushes.")
+		return nil, ErrServerOnly
 	}
 
+	// Check the origin stream can be used.
+	if err := checkPushOrigin(conn, origin); err != nil {
+		return nil, err
+	}
+	conn.Lock()
+	_, ok := conn.streams[origin.StreamID()]
+	conn.Unlock()
+	if !ok {
+		return nil, errors.New("Error: Origin stream is closed.")
+	}
+
+	opts, err := pushOptions(opts, origin, 3)
+	if err != nil {
+		return nil, err
+	}
+	priority := *opts.Priority
+
 	// Parse and check URL.
 	url, err := url.Parse(resource)
 	if err != nil {
@@ -210,6 +287,12 @@ func (conn *connV3) Push(resource string, origin Stream) (PushStream, error) {
 	}
 	resource = url.String()
 
+	// Check the resource shares the origin's authority.
+	request := streamRequest(origin)
+	if request == nil || !pushAuthorized(url, request, conn.tlsState != nil, serverCertificates(conn.server)) {
+		return nil, errors.New("Error: Pushed resource must have the same origin as the origin stream.")
+	}
+
 	// Ensure the resource hasn't been pushed on the given stream already.
 	if conn.pushedResources[origin] == nil {
 		conn.pushedResources[origin] = map[string]struct{}{
@@ -223,32 +306,42 @@ func (conn *connV3) Push(resource string, origin Stream) (PushStream, error) {
 
 	// Check stream limit would allow the new stream.
 	if !conn.pushStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return nil, &StreamError{Status: RST_STREAM_REFUSED_STREAM}
 	}
 
-	// Prepare the SYN_STREAM.
+	// Prepare the SYN_STREAM. The response's status
+	// and headers are sent later, in a HEADERS frame.
+	path := url.Path
+	if url.RawQuery != "" {
+		path += "?" + url.RawQuery
+	}
 	push := new(synStreamFrameV3)
 	push.Flags = FLAG_UNIDIRECTIONAL
 	push.AssocStreamID = origin.StreamID()
-	push.Priority = 7
-	push.Header = make(http.Header)
+	push.Priority = priority
+	push.Header = opts.Header
+	push.Header.Set(":method", opts.Method)
 	push.Header.Set(":scheme", url.Scheme)
 	push.Header.Set(":host", url.Host)
-	push.Header.Set(":path", url.Path)
+	push.Header.Set(":path", path)
 	push.Header.Set(":version", "HTTP/1.1")
-	push.Header.Set(":status", "200 OK")
 
-	// Send.
-	conn.Lock()
-	defer conn.Unlock()
+	// Send. Pushes are sent one at a time, so that their
+	// stream IDs reach the client in order. The connection
+	// is not locked while the SYN_STREAM is handed to the
+	// sender, which may need the lock to make progress.
+	conn.streamLock.Lock()
+	defer conn.streamLock.Unlock()
 
+	conn.Lock()
 	conn.lastPushStreamID += 2
 	if conn.lastPushStreamID > MAX_STREAM_ID {
+		conn.pushStreamLimit.Close()
+		conn.Unlock()
 		return nil, errors.New("Error: All server streams exhausted.")
 	}
 	newID := conn.lastPushStreamID
 	push.StreamID = newID
-	conn.output[0] <- push
 
 	// Create the pushStream.
 	out := new(pushStreamV3)
@@ -256,30 +349,164 @@ func (conn *connV3) Push(resource string, origin Stream) (PushStream, error) {
 	out.streamID = newID
 	out.origin = origin
 	out.state = new(StreamState)
-	out.output = conn.output[7]
-	out.header = make(http.Header)
+	out.output = conn.output[priority]
+	out.priority = priority
+	out.header = opts.ResponseHeader
+	out.status = opts.Status
 	out.stop = conn.stop
 	out.AddFlowControl(conn.flowControl)
 
 	// Store in the connection map.
-	conn.streams[newID] = out
+	conn.addStream(newID, out)
+	conn.setStreamPriority(newID, priority)
+	conn.Unlock()
+
+	// The SYN_STREAM has been received by the sender
+	// once this completes, so it is written before any
+	// DATA sent later on the origin stream, whatever
+	// their priorities.
+	select {
+	case conn.output[0] <- push:
+	case <-conn.stop:
+		return nil, ErrConnClosed
+	}
 
 	return out, nil
 }
 
 // Request is used to make a client request.
 func (conn *connV3) Request(request *http.Request, receiver Receiver, priority Priority) (Stream, error) {
+	stream, err := conn.request(request, receiver, priority, false)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// RequestDuplex is used to make a client request whose
+// body is written while the response is received.
+func (conn *connV3) RequestDuplex(request *http.Request, priority Priority) (*DuplexStream, error) {
+	res := newDuplexResponse(request, ":status", ":version")
+	res.TLS = conn.tlsState
+	stream, err := conn.request(request, res, priority, true)
+	if err != nil {
+		return nil, err
+	}
+	return newDuplexStream(stream, res), nil
+}
+
+// OpenStream opens a raw stream, sending the given headers.
+func (conn *connV3) OpenStream(header http.Header, priority Priority) (RawStream, error) {
+	if conn.goawayReceived || conn.goawaySent {
+		return nil, ErrGoaway
+	}
+
+	if !priority.Valid(3) {
+		return nil, errors.New("Error: Priority must be in the range 0 - 7.")
+	}
+
+	if header.Get(":method") != "" {
+		return nil, errors.New("Error: Raw streams cannot carry requests.")
+	}
+
+	// Check stream limit would allow the new stream.
+	limit := conn.requestStreamLimit
+	if conn.server != nil {
+		limit = conn.pushStreamLimit
+	}
+	if !limit.Add() {
+		return nil, &StreamError{Status: RST_STREAM_REFUSED_STREAM}
+	}
+
+	syn := new(synStreamFrameV3)
+	syn.Priority = priority
+	syn.Header = make(http.Header)
+	for name, values := range header {
+		syn.Header[name] = values
+	}
+
+	// Send. Streams are opened one at a time, as
+	// with requests and pushes, so that their IDs
+	// reach the other endpoint in order. Clients
+	// use odd stream IDs, and servers even.
+	conn.streamLock.Lock()
+	defer conn.streamLock.Unlock()
+
+	conn.Lock()
+	if conn.closed() {
+		limit.Close()
+		conn.Unlock()
+		return nil, ErrConnClosed
+	}
+	if conn.server == nil {
+		if conn.lastRequestStreamID == 0 {
+			conn.lastRequestStreamID = 1
+		} else {
+			conn.lastRequestStreamID += 2
+		}
+		syn.StreamID = conn.lastRequestStreamID
+	} else {
+		conn.lastPushStreamID += 2
+		syn.StreamID = conn.lastPushStreamID
+	}
+	if syn.StreamID > MAX_STREAM_ID {
+		limit.Close()
+		conn.Unlock()
+		return nil, errors.New("Error: All streams exhausted.")
+	}
+
+	// Create the stream, and store it
+	// in the connection map.
+	out := conn.newRawStream(syn.StreamID, priority, nil)
+	out.replied = true
+	conn.addStream(syn.StreamID, out)
+	conn.setStreamPriority(syn.StreamID, priority)
+	conn.Unlock()
+
+	select {
+	case conn.output[0] <- syn:
+	case <-conn.stop:
+		return nil, ErrConnClosed
+	}
+
+	return out, nil
+}
+
+// Accept waits for the other endpoint to
+// open a raw stream, and returns it, once
+// the stream has been acknowledged with
+// SYN_REPLY. Raw streams must first be
+// enabled with SetRawStreams.
+func (conn *connV3) Accept() (RawStream, error) {
+	if !conn.rawStreamsEnabled() {
+		return nil, ErrRawStreamsOff
+	}
+
+	select {
+	case stream := <-conn.accepted:
+		stream.reply()
+		return stream, nil
+	case <-conn.stop:
+		return nil, ErrConnClosed
+	}
+}
+
+// request sends the SYN_STREAM for a client request. If
+// duplex is false, the request body is sent at once, and
+// the stream is half-closed. Otherwise, the request body
+// is left to be written to the stream.
+func (conn *connV3) request(request *http.Request, receiver Receiver, priority Priority, duplex bool) (*clientStreamV3, error) {
 	if conn.goawayReceived || conn.goawaySent {
 		return nil, ErrGoaway
 	}
 
 	if conn.server != nil {
-		return nil, errors.New("Error: Only clients can send requests.")
+		return nil, ErrClientOnly
 	}
 
 	// Check stream limit would allow the new stream.
 	if !conn.requestStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return nil, &StreamError{Status: RST_STREAM_REFUSED_STREAM}
 	}
 
 	if !priority.Valid(3) {
@@ -310,7 +537,9 @@ func (conn *connV3) Request(request *http.Request, receiver Receiver, priority P
 
 	// Prepare the request body, if any.
 	body := make([]*dataFrameV3, 0, 1)
-	if request.Body != nil {
+	if duplex {
+		// The body is written to the stream later.
+	} else if request.Body != nil {
 		buf := make([]byte, 32*1024)
 		n, err := request.Body.Read(buf)
 		if err != nil && err != io.EOF {
@@ -341,32 +570,37 @@ func (conn *connV3) Request(request *http.Request, receiver Receiver, priority P
 		syn.Flags = FLAG_FIN
 	}
 
-	// Send.
-	conn.Lock()
-	defer conn.Unlock()
+	// Send. Streams are opened one at a time, so that
+	// their stream IDs reach the server in order. The
+	// connection is not locked while the frames are
+	// handed to the sender, which may need the lock to
+	// make progress.
+	conn.streamLock.Lock()
+	defer conn.streamLock.Unlock()
 
+	conn.Lock()
 	if conn.lastRequestStreamID == 0 {
 		conn.lastRequestStreamID = 1
 	} else {
 		conn.lastRequestStreamID += 2
 	}
 	if conn.lastRequestStreamID > MAX_STREAM_ID {
+		conn.requestStreamLimit.Close()
+		conn.Unlock()
 		return nil, errors.New("Error: All client streams exhausted.")
 	}
 	syn.StreamID = conn.lastRequestStreamID
-	conn.output[0] <- syn
-	for _, frame := range body {
-		frame.StreamID = syn.StreamID
-		conn.output[0] <- frame
-	}
 
 	// Create the request stream.
 	out := new(clientStreamV3)
 	out.conn = conn
 	out.streamID = syn.StreamID
 	out.state = new(StreamState)
-	out.state.CloseHere()
-	out.output = conn.output[0]
+	if !duplex {
+		out.state.CloseHere()
+	}
+	out.output = conn.output[priority]
+	out.priority = priority
 	out.request = request
 	out.receiver = receiver
 	out.header = make(http.Header)
@@ -375,7 +609,23 @@ func (conn *connV3) Request(request *http.Request, receiver Receiver, priority P
 	out.AddFlowControl(conn.flowControl)
 
 	// Store in the connection map.
-	conn.streams[syn.StreamID] = out
+	conn.addStream(syn.StreamID, out)
+	conn.setStreamPriority(syn.StreamID, priority)
+	conn.Unlock()
+
+	select {
+	case conn.output[0] <- syn:
+	case <-conn.stop:
+		return nil, ErrConnClosed
+	}
+	for _, frame := range body {
+		frame.StreamID = syn.StreamID
+		select {
+		case conn.output[0] <- frame:
+		case <-conn.stop:
+			return nil, ErrConnClosed
+		}
+	}
 
 	return out, nil
 }
@@ -385,6 +635,9 @@ func (c *connV3) RequestResponse(request *http.Request, receiver Receiver, prior
 	res.Request = request
 	res.Data = new(bytes.Buffer)
 	res.Receiver = receiver
+	res.TLS = c.tlsState
+	res.statusHeader = ":status"
+	res.versionHeader = ":version"
 
 	// Send the request.
 	stream, err := c.Request(request, res, priority)
@@ -392,8 +645,13 @@ func (c *connV3) RequestResponse(request *http.Request, receiver Receiver, prior
 		return nil, err
 	}
 
-	// Let the request run its course.
-	stream.Run()
+	// Let the request run its course, reporting
+	// a reset by the server or an exceeded deadline.
+	if err := stream.Run(); err != nil {
+		if _, ok := err.(*StreamError); ok || err == os.ErrDeadlineExceeded {
+			return nil, err
+		}
+	}
 
 	return res.Response(), nil
 }
@@ -422,7 +680,9 @@ func (conn *connV3) Run() error {
 	// Run until the connection ends.
 	<-conn.stop
 
-	return nil
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.err
 }
 
 func (c *connV3) SetFlowControl(f FlowControl) error {
@@ -432,6 +692,68 @@ func (c *connV3) SetFlowControl(f FlowControl) error {
 	return nil
 }
 
+// SetKeepAlive starts sending a PING every interval, closing the
+// connection if maxMissed consecutive PINGs go unanswered. This
+// can be used to detect half-open connections. If maxMissed is
+// less than 1, 1 is used. An interval of 0 stops the keepalive.
+func (c *connV3) SetKeepAlive(interval time.Duration, maxMissed int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.keepAliveStop != nil {
+		close(c.keepAliveStop)
+		c.keepAliveStop = nil
+	}
+	if interval <= 0 || c.closed() {
+		return
+	}
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+	c.keepAliveStop = make(chan struct{})
+	go keepAlive(c, interval, maxMissed, c.keepAliveStop)
+}
+
+// SetIdleTimeout closes the connection, with a GOAWAY, once it
+// has had no active streams for the given duration. A timeout
+// of 0 disables the idle timeout.
+func (c *connV3) SetIdleTimeout(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.idleStop != nil {
+		close(c.idleStop)
+		c.idleStop = nil
+	}
+	if d <= 0 || c.closed() {
+		return
+	}
+	c.idleStop = make(chan struct{})
+	go idleTimeout(c, d, c.idleStop)
+}
+
+// SetRawStreams sets whether raw streams opened by the other
+// endpoint are accepted. They are not by default, so that the
+// other endpoint cannot fill the backlog of a connection which
+// never calls Accept. While they are disabled, a SYN_STREAM
+// with no method is treated as an incomplete request, and
+// answered with 400 Bad Request, or as an invalid push. Raw
+// streams should be enabled before Run is called, so that
+// none are missed.
+func (c *connV3) SetRawStreams(enabled bool) {
+	c.Lock()
+	c.rawStreams = enabled
+	c.Unlock()
+}
+
+// rawStreamsEnabled indicates whether raw streams
+// from the other endpoint are accepted.
+func (c *connV3) rawStreamsEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.rawStreams
+}
+
 func (c *connV3) SetTimeout(d time.Duration) {
 	c.Lock()
 	c.readTimeout = d
@@ -462,6 +784,70 @@ func (conn *connV3) closed() bool {
 	}
 }
 
+// activeStreams returns the number of streams
+// which have not yet been closed.
+func (conn *connV3) activeStreams() int {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.reapStreams()
+}
+
+// lastActivity returns the last time the
+// connection was seen to have active streams.
+func (conn *connV3) lastActivity() time.Time {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.reapStreams()
+	return conn.lastActive
+}
+
+// addStream stores a new stream in the connection map.
+// The stream's place in the stream limits is freed as
+// soon as it is closed. The caller must hold the
+// connection's lock.
+func (conn *connV3) addStream(sid StreamID, stream Stream) {
+	conn.streams[sid] = stream
+	limit := conn.requestStreamLimit
+	if sid&1 == 0 {
+		limit = conn.pushStreamLimit
+	}
+	stream.State().onClose(limit.Close)
+}
+
+// reapStreams removes closed streams from the connection,
+// and returns the number of streams which remain active.
+// The caller must hold the connection's lock.
+func (conn *connV3) reapStreams() int {
+	active := 0
+	for sid, stream := range conn.streams {
+		if state := stream.State(); state != nil && !state.Closed() {
+			active++
+			continue
+		}
+
+		delete(conn.streams, sid)
+		delete(conn.pushedResources, stream)
+		conn.priorityLock.Lock()
+		delete(conn.priorities, sid)
+		conn.priorityLock.Unlock()
+		conn.lastActive = time.Now()
+	}
+	if active > 0 {
+		conn.lastActive = time.Now()
+	}
+	return active
+}
+
+// setError records the reason the connection is ending,
+// which is returned by Run. Only the first reason is kept.
+func (conn *connV3) setError(err error) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.err == nil {
+		conn.err = err
+	}
+}
+
 // handleClientData performs the processing of DATA frames sent by the client.
 func (conn *connV3) handleClientData(frame *dataFrameV3) {
 	conn.Lock()
@@ -520,10 +906,17 @@ func (conn *connV3) handleHeaders(frame *headersFrameV3) {
 	// Handle push headers.
 	if sid&1 == 0 && conn.server == nil {
 		// Ignore refused push headers.
-		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
-			conn.pushReceiver.ReceiveHeader(req, frame.Header)
+		req := conn.pushRequests[sid]
+		if req != nil && frame.Flags.FIN() {
+			conn.endPush(sid)
 		}
 		conn.Unlock()
+		if req != nil {
+			conn.pushReceiver.ReceiveHeader(req, frame.Header)
+			if frame.Flags.FIN() {
+				conn.pushReceiver.ReceiveData(req, []byte{}, true)
+			}
+		}
 		return
 	}
 
@@ -593,29 +986,44 @@ func (conn *connV3) handlePush(frame *synStreamFrameV3) {
 
 	// Stream ID is fine.
 
-	// Check stream limit would allow the new stream.
-	if !conn.pushStreamLimit.Add() {
-		rst := new(rstStreamFrameV3)
-		rst.StreamID = sid
-		rst.Status = RST_STREAM_REFUSED_STREAM
-		conn.output[0] <- rst
+	if !frame.Priority.Valid(3) {
+		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
 		conn.Unlock()
+		conn.protocolError(sid)
 		return
 	}
 
-	if !frame.Priority.Valid(3) {
-		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
+	// Check the push is associated with an open request.
+	assoc, ok := conn.streams[frame.AssocStreamID]
+	if frame.AssocStreamID&1 == 0 || !ok || assoc.State().ClosedThere() {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, associated with stream %d, which is not open.\n", sid, frame.AssocStreamID)
+		conn.numBenignErrors++
+		conn.refusePush(sid, RST_STREAM_INVALID_STREAM)
 		conn.Unlock()
-		conn.protocolError(sid)
 		return
 	}
 
 	// Parse the request.
 	header := frame.Header
+	if header.Get(":scheme") == "" || header.Get(":host") == "" || header.Get(":path") == "" {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which is missing the pushed URL.\n", sid)
+		conn.refusePush(sid, RST_STREAM_PROTOCOL_ERROR)
+		conn.Unlock()
+		return
+	}
 	rawUrl := header.Get(":scheme") + "://" + header.Get(":host") + header.Get(":path")
 	url, err := url.Parse(rawUrl)
 	if err != nil {
 		log.Println("Error: Received SYN_STREAM with invalid request URL: ", err)
+		conn.refusePush(sid, RST_STREAM_PROTOCOL_ERROR)
+		conn.Unlock()
+		return
+	}
+
+	// Check the server is authoritative for the resource.
+	if origin := streamRequest(assoc); origin == nil || !pushAuthorized(url, origin, conn.tlsState != nil, peerCertificates(conn.tlsState)) {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, pushing %q, which is not from the same origin.\n", sid, url)
+		conn.refusePush(sid, RST_STREAM_REFUSED_STREAM)
 		conn.Unlock()
 		return
 	}
@@ -643,25 +1051,151 @@ func (conn *connV3) handlePush(frame *synStreamFrameV3) {
 		TLS:        conn.tlsState,
 	}
 
+	// Check stream limit would allow the new stream.
+	if !conn.pushStreamLimit.Add() {
+		rst := new(rstStreamFrameV3)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_REFUSED_STREAM
+		conn.output[0] <- rst
+		conn.Unlock()
+		return
+	}
+
+	// The push can be identified, such as
+	// to cancel it, using its context.
+	info := &StreamInfo{Conn: conn, StreamID: sid, Priority: frame.Priority, Version: connVersion(conn)}
+	request = request.WithContext(context.WithValue(context.Background(), streamInfoKey, info))
+
 	// Check whether the receiver wants this resource.
-	if conn.pushReceiver != nil && !conn.pushReceiver.ReceiveRequest(request) {
+	if conn.pushReceiver == nil || !conn.pushReceiver.ReceiveRequest(request) {
 		rst := new(rstStreamFrameV3)
 		rst.StreamID = sid
 		rst.Status = RST_STREAM_REFUSED_STREAM
 		conn.output[0] <- rst
+		conn.pushStreamLimit.Close()
 		conn.Unlock()
 		return
 	}
 
 	// Create and start new stream.
-	if conn.pushReceiver != nil {
-		conn.pushRequests[sid] = request
-		conn.lastPushStreamID = sid
+	conn.pushRequests[sid] = request
+	conn.lastPushStreamID = sid
+	if frame.Flags.FIN() {
+		conn.endPush(sid)
+	}
+	conn.Unlock()
+	conn.pushReceiver.ReceiveHeader(request, frame.Header)
+	if frame.Flags.FIN() {
+		conn.pushReceiver.ReceiveData(request, []byte{}, true)
+	}
+}
+
+// handleRawFrame passes a frame to the raw stream with the
+// given ID, returning false if it is not a raw stream.
+func (conn *connV3) handleRawFrame(sid StreamID, frame Frame) bool {
+	conn.Lock()
+	stream, ok := conn.streams[sid].(*rawStreamV3)
+	if !ok {
 		conn.Unlock()
-		conn.pushReceiver.ReceiveHeader(request, frame.Header)
-	} else {
+		return false
+	}
+
+	// Check stream is open.
+	if stream.State().ClosedThere() {
+		debug.Printf("Warning: Received %s with Stream ID %d, which is closed.\n", frame.Name(), sid)
 		conn.Unlock()
+		return true
 	}
+	conn.Unlock()
+
+	// Stream ID is fine.
+
+	// Send frame to stream.
+	stream.ReceiveFrame(frame)
+	return true
+}
+
+// handleRawStream performs the processing of SYN_STREAM frames
+// opening a raw stream.
+func (conn *connV3) handleRawStream(frame *synStreamFrameV3) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	// Check stream creation is allowed.
+	if conn.goawayReceived || conn.goawaySent || conn.closed() {
+		return
+	}
+
+	sid := frame.StreamID
+
+	// Check Stream ID was chosen by the other endpoint.
+	if sid&1 == conn.oddity {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which is reserved for this endpoint.\n", sid)
+		conn.numBenignErrors++
+		return
+	}
+
+	// Raw streams from clients are counted as
+	// requests, and those from servers as pushes.
+	last, limit := &conn.lastPushStreamID, conn.pushStreamLimit
+	if conn.server != nil {
+		last, limit = &conn.lastRequestStreamID, conn.requestStreamLimit
+	}
+
+	// Check Stream ID is the right number.
+	if lsid := *last; sid <= lsid {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be greater than %d.\n", sid, lsid)
+		conn.numBenignErrors++
+		return
+	}
+
+	// Check Stream ID is not out of bounds.
+	if !sid.Valid() {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which exceeds the limit.\n", sid)
+		conn.Unlock()
+		conn.protocolError(sid)
+		conn.Lock()
+		return
+	}
+
+	// Stream ID is fine.
+
+	if !frame.Priority.Valid(3) {
+		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
+		conn.Unlock()
+		conn.protocolError(sid)
+		conn.Lock()
+		return
+	}
+
+	*last = sid
+
+	// Check stream limit would allow the new
+	// stream, and that it can be accepted.
+	if len(conn.accepted) == cap(conn.accepted) || !limit.Add() {
+		rst := new(rstStreamFrameV3)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_REFUSED_STREAM
+		conn.output[0] <- rst
+		return
+	}
+
+	// Create the new stream.
+	stream := conn.newRawStream(sid, frame.Priority, frame.Header)
+	if frame.Flags.UNIDIRECTIONAL() {
+		stream.state.CloseHere()
+	}
+	if frame.Flags.FIN() {
+		stream.closeThere()
+	}
+
+	// Set and prepare.
+	conn.addStream(sid, stream)
+	conn.setStreamPriority(sid, frame.Priority)
+
+	// Only this goroutine sends on accepted,
+	// so there is room.
+	conn.accepted <- stream
 }
 
 // handleRequest performs the processing of SYN_STREAM request frames.
@@ -729,11 +1263,22 @@ func (conn *connV3) handleRequest(frame *synStreamFrameV3) {
 	nextStream := conn.newStream(frame, frame.Priority)
 	// Make sure an error didn't occur when making the stream.
 	if nextStream == nil {
+		// Reply with 400 Bad Request, as the spec requires.
+		reply := new(synReplyFrameV3)
+		reply.Flags = FLAG_FIN
+		reply.StreamID = sid
+		reply.Header = make(http.Header)
+		reply.Header.Set(":status", "400")
+		reply.Header.Set(":version", "HTTP/1.1")
+		conn.output[0] <- reply
+		conn.requestStreamLimit.Close()
+		conn.lastRequestStreamID = sid
 		return
 	}
 
 	// Set and prepare.
-	conn.streams[sid] = nextStream
+	conn.addStream(sid, nextStream)
+	conn.setStreamPriority(sid, frame.Priority)
 	conn.lastRequestStreamID = sid
 
 	// Start the stream.
@@ -747,33 +1292,43 @@ func (conn *connV3) handleRstStream(frame *rstStreamFrameV3) {
 
 	sid := frame.StreamID
 
+	// End any push the server has reset.
+	if sid&1 == 0 && conn.server == nil {
+		if req := conn.endPush(sid); req != nil {
+			go pushCancelled(conn.pushReceiver, req)
+		}
+	}
+
 	// Determine the status code and react accordingly.
 	switch frame.Status {
 	case RST_STREAM_INVALID_STREAM:
 		log.Printf("Error: Received INVALID_STREAM for stream ID %d.\n", sid)
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 		conn.numBenignErrors++
 
-	case RST_STREAM_REFUSED_STREAM:
+	case RST_STREAM_REFUSED_STREAM, RST_STREAM_INTERNAL_ERROR:
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 
 	case RST_STREAM_CANCEL:
-		// Allow cancelling of pushes.
+		// Allow cancelling of pushes, of requests
+		// by the server, and of raw streams.
 		stream, ok := conn.streams[sid]
 		if !ok {
 			return
 		}
-		_, ok = stream.(*pushStreamV3)
-		if sid&1 == conn.oddity && !ok {
+		_, push := stream.(*pushStreamV3)
+		_, request := stream.(*clientStreamV3)
+		_, raw := stream.(*rawStreamV3)
+		if sid&1 == conn.oddity && !push && !request && !raw {
 			log.Println("Error: Cannot cancel locally-sent streams.")
 			conn.numBenignErrors++
 			return
 		}
-		stream.Close()
+		closeResetStream(stream, frame.Status)
 
 	case RST_STREAM_FLOW_CONTROL_ERROR:
 		conn.numBenignErrors++
@@ -785,7 +1340,7 @@ func (conn *connV3) handleRstStream(frame *rstStreamFrameV3) {
 	case RST_STREAM_STREAM_ALREADY_CLOSED:
 		log.Printf("Error: Received STREAM_ALREADY_CLOSED for stream ID %d.\n", sid)
 		if stream, ok := conn.streams[sid]; ok {
-			go stream.Close()
+			go closeResetStream(stream, frame.Status)
 		}
 		conn.numBenignErrors++
 
@@ -813,8 +1368,12 @@ func (conn *connV3) handleServerData(frame *dataFrameV3) {
 	// Handle push data.
 	if sid&1 == 0 {
 		// Ignore refused push data.
+		req := conn.pushRequests[sid]
+		if req != nil && frame.Flags.FIN() {
+			conn.endPush(sid)
+		}
 		conn.Unlock()
-		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
+		if req != nil {
 			conn.pushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
 		}
 		return
@@ -846,16 +1405,19 @@ func (conn *connV3) handleSynReply(frame *synReplyFrameV3) {
 
 	sid := frame.StreamID
 
-	if conn.server != nil {
+	// Servers only receive SYN_REPLY
+	// frames for raw streams.
+	_, raw := conn.streams[sid].(*rawStreamV3)
+	if conn.server != nil && !raw {
 		log.Println("Error: Only clients can receive SYN_REPLY frames.")
 		conn.numBenignErrors++
 		conn.Unlock()
 		return
 	}
 
-	// Check Stream ID is odd.
-	if sid&1 == 0 {
-		log.Printf("Error: Received SYN_REPLY with Stream ID %d, which should be odd.\n", sid)
+	// Check Stream ID was chosen by this endpoint.
+	if sid&1 != conn.oddity {
+		log.Printf("Error: Received SYN_REPLY with Stream ID %d, which was not opened by this endpoint.\n", sid)
 		conn.numBenignErrors++
 		conn.Unlock()
 		return
@@ -922,6 +1484,13 @@ func (conn *connV3) handleWindowUpdate(frame *windowUpdateFrameV3) {
 		}
 		conn.connectionWindowSize += int64(delta)
 		conn.Unlock()
+
+		// Let the send loop retry any
+		// buffered DATA frames.
+		select {
+		case conn.windowGrown <- struct{}{}:
+		default:
+		}
 		return
 	}
 
@@ -947,7 +1516,7 @@ func (conn *connV3) newStream(frame *synStreamFrameV3, priority Priority) *serve
 	stream.conn = conn
 	stream.streamID = frame.StreamID
 	// stream.flow is initialised in stream.AddFlowControl below.
-	stream.requestBody = new(bytes.Buffer)
+	stream.requestBody = newBodyBuffer()
 	stream.state = new(StreamState)
 	stream.output = conn.output[priority]
 	// stream.request initialised below.
@@ -958,52 +1527,82 @@ func (conn *connV3) newStream(frame *synStreamFrameV3, priority Priority) *serve
 	stream.header = make(http.Header)
 	stream.unidirectional = frame.Flags.UNIDIRECTIONAL()
 	stream.responseCode = 0
-	stream.ready = make(chan struct{})
 	stream.stop = conn.stop
 	stream.wroteHeader = false
 	stream.priority = priority
+	stream.closeNotify = make(chan bool)
+	stream.timeout = conn.requestTimeout
+	stream.timeoutStatus = conn.timeoutStatus
+	stream.pushPreload = conn.pushPreload
+	stream.pushPolicy = conn.pushPolicy
+	stream.pushHistory = conn.pushHistory
 
 	if frame.Flags.FIN() {
-		close(stream.ready)
+		stream.requestBody.finish(nil)
 		stream.state.CloseThere()
 	}
 
-	header := frame.Header
-	rawUrl := header.Get(":scheme") + "://" + header.Get(":host") + header.Get(":path")
-
-	url, err := url.Parse(rawUrl)
+	// Build this into a request to present to the Handler.
+	request, err := newServerRequest(frame.Header, requestHeadersV3, frame.Flags.FIN())
 	if err != nil {
-		log.Println("Error: Received SYN_STREAM with invalid request URL: ", err)
+		log.Println(err)
 		return nil
 	}
+	request.RemoteAddr = conn.remoteAddr
+	request.TLS = conn.tlsState
+	if request.Body == nil {
+		request.Body = stream.requestBody
+	}
+	stream.request = request
 
-	vers := header.Get(":version")
-	major, minor, ok := http.ParseHTTPVersion(vers)
+	stream.AddFlowControl(conn.flowControl)
+	ctx := newStreamContext(serverContext(conn.server, conn.conn), stream, conn.pushStreamLimit.Limit() > 0)
+	ctx, cancel := context.WithCancel(ctx)
+	stream.request = stream.request.WithContext(ctx)
+	stream.cancel = cancel
+
+	return stream
+}
+
+// refusePush rejects a server push with RST_STREAM
+// and the given status. The connection must be locked.
+func (conn *connV3) refusePush(sid StreamID, status StatusCode) {
+	rst := new(rstStreamFrameV3)
+	rst.StreamID = sid
+	rst.Status = status
+	conn.output[0] <- rst
+}
+
+// endPush removes a server push which has finished, freeing
+// its place in the push stream limit, and returns its request.
+// The connection must be locked.
+func (conn *connV3) endPush(sid StreamID) *http.Request {
+	req, ok := conn.pushRequests[sid]
 	if !ok {
-		log.Println("Error: Invalid HTTP version: " + vers)
 		return nil
 	}
+	delete(conn.pushRequests, sid)
+	conn.pushStreamLimit.Close()
+	return req
+}
 
-	method := header.Get(":method")
-
-	// Build this into a request to present to the Handler.
-	stream.request = &http.Request{
-		Method:     method,
-		URL:        url,
-		Proto:      vers,
-		ProtoMajor: major,
-		ProtoMinor: minor,
-		RemoteAddr: conn.remoteAddr,
-		Header:     header,
-		Host:       url.Host,
-		RequestURI: url.Path,
-		TLS:        conn.tlsState,
-		Body:       &readCloser{stream.requestBody},
+// cancelPush cancels an accepted server push by sending
+// RST_STREAM with status CANCEL.
+func (conn *connV3) cancelPush(sid StreamID) error {
+	conn.Lock()
+	req := conn.endPush(sid)
+	conn.Unlock()
+	if req == nil {
+		return errors.New("Error: Push is not in progress.")
 	}
 
-	stream.AddFlowControl(conn.flowControl)
+	rst := new(rstStreamFrameV3)
+	rst.StreamID = sid
+	rst.Status = RST_STREAM_CANCEL
+	conn.output[0] <- rst
 
-	return stream
+	pushCancelled(conn.pushReceiver, req)
+	return nil
 }
 
 // handleReadWriteError differentiates between normal and
@@ -1018,6 +1617,11 @@ func (conn *connV3) handleReadWriteError(err error) {
 		log.Printf("Error: Encountered error: %q (%T)\n", err.Error(), err)
 	}
 
+	// Record the error, unless the connection was closed locally.
+	if !conn.closed() {
+		conn.setError(&ConnectionError{Cause: err})
+	}
+
 	// Make sure conn.Close succeeds and sending stops.
 	conn.Lock()
 	if conn.sending == nil {
@@ -1031,6 +1635,16 @@ func (conn *connV3) handleReadWriteError(err error) {
 // protocolError informs the other endpoint that a protocol error has
 // occurred, stops all running streams, and ends the connection.
 func (conn *connV3) protocolError(streamID StreamID) {
+	lastGood := conn.lastPushStreamID
+	if conn.server != nil {
+		lastGood = conn.lastRequestStreamID
+	}
+	err := &ConnectionError{GoawayStatus: GOAWAY_PROTOCOL_ERROR, LastGoodStreamID: lastGood}
+	if streamID != 0 {
+		err.Cause = &StreamError{ID: streamID, Status: RST_STREAM_PROTOCOL_ERROR}
+	}
+	conn.setError(err)
+
 	reply := new(rstStreamFrameV3)
 	reply.StreamID = streamID
 	reply.Status = RST_STREAM_PROTOCOL_ERROR
@@ -1044,11 +1658,7 @@ func (conn *connV3) protocolError(streamID StreamID) {
 
 	if !conn.goawaySent {
 		goaway := new(goawayFrameV3)
-		if conn.server != nil {
-			goaway.LastGoodStreamID = conn.lastRequestStreamID
-		} else {
-			goaway.LastGoodStreamID = conn.lastPushStreamID
-		}
+		goaway.LastGoodStreamID = lastGood
 		goaway.Status = GOAWAY_PROTOCOL_ERROR
 		select {
 		case conn.output[0] <- goaway:
@@ -1069,7 +1679,9 @@ func (conn *connV3) processFrame(frame Frame) bool {
 	switch frame := frame.(type) {
 
 	case *synStreamFrameV3:
-		if conn.server == nil {
+		if isRawStream(frame) && conn.rawStreamsEnabled() {
+			conn.handleRawStream(frame)
+		} else if conn.server == nil {
 			conn.handlePush(frame)
 		} else {
 			conn.handleRequest(frame)
@@ -1083,27 +1695,33 @@ func (conn *connV3) processFrame(frame Frame) bool {
 		f3.Slot = 0
 		f3.Header = frame.Header
 		f3.rawHeader = frame.rawHeader
-		if conn.server == nil {
+		if isRawStream(f3) && conn.rawStreamsEnabled() {
+			conn.handleRawStream(f3)
+		} else if conn.server == nil {
 			conn.handlePush(f3)
 		} else {
 			conn.handleRequest(f3)
 		}
 
 	case *synReplyFrameV3:
-		conn.handleSynReply(frame)
+		if !conn.handleRawFrame(frame.StreamID, frame) {
+			conn.handleSynReply(frame)
+		}
 
 	case *rstStreamFrameV3:
 		if statusCodeIsFatal(frame.Status) {
 			code := statusCodeText[frame.Status]
 			log.Printf("Warning: Received %s on stream %d. Closing connection.\n", code, frame.StreamID)
-			conn.Close()
+			closeWithError(conn, &ConnectionError{Cause: &StreamError{ID: frame.StreamID, Status: frame.Status}})
 			return true
 		}
 		conn.handleRstStream(frame)
 
 	case *settingsFrameV3:
 		for _, setting := range frame.Settings {
+			conn.Lock()
 			conn.receivedSettings[setting.ID] = setting
+			conn.Unlock()
 			switch setting.ID {
 			case SETTINGS_INITIAL_WINDOW_SIZE:
 				conn.Lock()
@@ -1116,7 +1734,7 @@ func (conn *connV3) processFrame(frame Frame) bool {
 					} else {
 						conn.connectionWindowSize += (inbound - initial)
 					}
-					conn.initialWindowSize = setting.Value
+					atomic.StoreUint32(&conn.initialWindowSize, setting.Value)
 				}
 				conn.Unlock()
 
@@ -1132,14 +1750,20 @@ func (conn *connV3) processFrame(frame Frame) bool {
 	case *pingFrameV3:
 		// Check whether Ping ID is a response.
 		if frame.PingID&1 == conn.nextPingID&1 {
-			if conn.pings[frame.PingID] == nil {
+			conn.Lock()
+			c := conn.pings[frame.PingID]
+			if c == nil {
+				conn.Unlock()
 				log.Printf("Warning: Ignored unrequested PING with Ping ID %d.\n", frame.PingID)
 				conn.numBenignErrors++
 				return false
 			}
-			conn.pings[frame.PingID] <- Ping{}
-			close(conn.pings[frame.PingID])
+			rtt := time.Since(conn.pingSent[frame.PingID])
 			delete(conn.pings, frame.PingID)
+			delete(conn.pingSent, frame.PingID)
+			conn.Unlock()
+			conn.stats.ping(rtt)
+			c <- rtt
 		} else {
 			debug.Println("Received PING. Replying...")
 			conn.output[0] <- frame
@@ -1155,9 +1779,16 @@ func (conn *connV3) processFrame(frame Frame) bool {
 			}
 		}
 		conn.goawayReceived = true
+		conn.setError(&ConnectionError{
+			GoawayStatus:     frame.Status,
+			LastGoodStreamID: frame.LastGoodStreamID,
+			Cause:            ErrGoaway,
+		})
 
 	case *headersFrameV3:
-		conn.handleHeaders(frame)
+		if !conn.handleRawFrame(frame.StreamID, frame) {
+			conn.handleHeaders(frame)
+		}
 
 	case *windowUpdateFrameV3:
 		conn.handleWindowUpdate(frame)
@@ -1190,7 +1821,7 @@ func (conn *connV3) processFrame(frame Frame) bool {
 				goaway := new(goawayFrameV3)
 				goaway.Status = GOAWAY_FLOW_CONTROL_ERROR
 				conn.output[0] <- goaway
-				conn.Close()
+				closeWithError(conn, &ConnectionError{GoawayStatus: GOAWAY_FLOW_CONTROL_ERROR})
 			}
 
 			conn.connectionWindowSizeThere -= int64(len(frame.Data))
@@ -1204,7 +1835,9 @@ func (conn *connV3) processFrame(frame Frame) bool {
 				conn.connectionWindowSizeThere += int64(grow.DeltaWindowSize)
 			}
 		}
-		if conn.server == nil {
+		if conn.handleRawFrame(frame.StreamID, frame) {
+			// Raw stream data.
+		} else if conn.server == nil {
 			conn.handleServerData(frame)
 		} else {
 			conn.handleClientData(frame)
@@ -1233,6 +1866,7 @@ func (conn *connV3) readFrames() {
 
 		// ReadFrame takes care of the frame parsing for us.
 		conn.refreshReadTimeout()
+		start := bytesRead(conn.buf, conn.counter)
 		frame, err := readFrameV3(conn.buf, conn.subversion)
 		if err != nil {
 			conn.handleReadWriteError(err)
@@ -1242,6 +1876,10 @@ func (conn *connV3) readFrames() {
 		// Print frame type.
 		debug.Printf("Receiving %s:\n", frame.Name())
 
+		// Measure the frame before its headers are decompressed.
+		size := bytesRead(conn.buf, conn.counter) - start
+		compressed, _, hasHeader := headerSizes(frame)
+
 		// Decompress the frame's headers, if there are any.
 		err = frame.Decompress(conn.decompressor)
 		if err != nil {
@@ -1250,9 +1888,22 @@ func (conn *connV3) readFrames() {
 			return
 		}
 
+		conn.stats.frameReceived(frame, size)
+		if hasHeader {
+			_, uncompressed, _ := headerSizes(frame)
+			conn.stats.headersReceived(uncompressed, compressed)
+		}
+
 		// Print frame once the content's been decompressed.
 		debug.Println(frame)
 
+		// Record the frame if the session is being captured.
+		if capture := conn.captureWriter(); capture != nil {
+			if err := capture.WriteFrame(true, frame); err != nil {
+				log.Println("Error in capture: ", err)
+			}
+		}
+
 		// This is the main frame handling.
 		if conn.processFrame(frame) {
 			return
@@ -1274,7 +1925,6 @@ func (conn *connV3) send() {
 	}()
 
 	// Enter the processing loop.
-Loop:
 	i := 1
 	for {
 
@@ -1296,27 +1946,6 @@ Loop:
 			return
 		}
 
-		// Process connection-level flow control.
-		if conn.subversion > 0 {
-			if frame, ok := frame.(*dataFrameV3); ok {
-				size := int64(8 + len(frame.Data))
-				if size > conn.connectionWindowSize {
-					// Buffer this frame and try again.
-					if conn.dataBuffer == nil {
-						conn.dataBuffer = []*dataFrameV3{frame}
-					} else {
-						buffer := make([]*dataFrameV3, 1, len(conn.dataBuffer)+1)
-						buffer[0] = frame
-						buffer = append(buffer, conn.dataBuffer...)
-						conn.dataBuffer = buffer
-					}
-					goto Loop
-				} else {
-					conn.connectionWindowSize -= size
-				}
-			}
-		}
-
 		// Compress any name/value header blocks.
 		err := frame.Compress(conn.compressor)
 		if err != nil {
@@ -1330,11 +1959,23 @@ Loop:
 		// Leave the specifics of writing to the
 		// connection up to the frame.
 		conn.refreshWriteTimeout()
-		_, err = frame.WriteTo(conn.conn)
+		n, err := frame.WriteTo(conn.conn)
 		if err != nil {
 			conn.handleReadWriteError(err)
 			return
 		}
+
+		conn.stats.frameSent(frame, n)
+		if compressed, uncompressed, ok := headerSizes(frame); ok {
+			conn.stats.headersSent(uncompressed, compressed)
+		}
+
+		// Record the frame if the session is being captured.
+		if capture := conn.captureWriter(); capture != nil {
+			if err := capture.WriteFrame(false, frame); err != nil {
+				log.Println("Error in capture: ", err)
+			}
+		}
 	}
 }
 
@@ -1343,27 +1984,34 @@ Loop:
 // (a smaller number) first. If the given boolean is false,
 // this priority is temporarily ignored, which can be used
 // when high load is ignoring low-priority frames.
-func (conn *connV3) selectFrameToSend(prioritise bool) (frame Frame) {
+//
+// With SPDY/3.1, DATA frames are held back while the
+// connection's transfer window is exhausted, along with
+// any later frames on the same stream.
+func (conn *connV3) selectFrameToSend(prioritise bool) Frame {
+	for {
+		frame, buffered := conn.nextFrame(prioritise)
+		if buffered || conn.subversion == 0 {
+			return frame
+		}
+		if frame = conn.admitFrame(frame); frame != nil {
+			return frame
+		}
+	}
+}
+
+// nextFrame returns the next frame to send, and whether
+// it is a frame which had been buffered for flow control,
+// and may now be sent.
+func (conn *connV3) nextFrame(prioritise bool) (frame Frame, buffered bool) {
 	if conn.closed() {
-		return nil
+		return nil, false
 	}
 
-	// Try buffered DATA frames first.
-	if conn.subversion > 0 {
-		if conn.dataBuffer != nil {
-			if len(conn.dataBuffer) == 0 {
-				conn.dataBuffer = nil
-			} else {
-				first := conn.dataBuffer[0]
-				if conn.connectionWindowSize >= int64(8+len(first.Data)) {
-					if len(conn.dataBuffer) > 1 {
-						conn.dataBuffer = conn.dataBuffer[1:]
-					} else {
-						conn.dataBuffer = nil
-					}
-					return first
-				}
-			}
+	// Try buffered frames first.
+	if conn.subversion > 0 && conn.dataBuffer != nil {
+		if frame = conn.nextBuffered(); frame != nil {
+			return frame, true
 		}
 	}
 
@@ -1372,7 +2020,7 @@ func (conn *connV3) selectFrameToSend(prioritise bool) (frame Frame) {
 		for i := 0; i < 8; i++ {
 			select {
 			case frame = <-conn.output[i]:
-				return frame
+				return frame, false
 			default:
 			}
 		}
@@ -1392,24 +2040,182 @@ func (conn *connV3) selectFrameToSend(prioritise bool) (frame Frame) {
 	// Wait for any frame.
 	select {
 	case frame = <-conn.output[0]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[1]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[2]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[3]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[4]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[5]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[6]:
-		return frame
+		return frame, false
 	case frame = <-conn.output[7]:
-		return frame
+		return frame, false
+	case <-conn.windowGrown:
+		// Buffered DATA frames may now be sent.
+		return conn.nextFrame(prioritise)
 	case _ = <-conn.stop:
+		return nil, false
+	}
+}
+
+// nextBuffered removes and returns the next buffered frame
+// which may be sent, or nil. Each stream's frames are sent
+// in order, so a frame other than DATA is sent as soon as
+// the data before it has been. Otherwise, the earliest DATA
+// frame with the highest priority is sent, as far as the
+// connection's transfer window allows.
+func (conn *connV3) nextBuffered() Frame {
+	next := -1
+	var best Priority
+	seen := make(map[StreamID]bool)
+	for i, frame := range conn.dataBuffer {
+		sid := orderedStreamID(frame)
+		if seen[sid] {
+			continue
+		}
+		seen[sid] = true
+
+		if _, ok := frame.(*dataFrameV3); !ok {
+			conn.removeBuffered(i)
+			return frame
+		}
+		if priority := conn.streamPriority(sid); next < 0 || priority < best {
+			next, best = i, priority
+		}
+	}
+	if next < 0 {
 		return nil
 	}
+
+	send, rest := conn.takeWindow(conn.dataBuffer[next].(*dataFrameV3))
+	if send == nil {
+		return nil
+	}
+	if rest != nil {
+		conn.dataBuffer[next] = rest
+	} else {
+		conn.removeBuffered(next)
+	}
+	return send
+}
+
+// removeBuffered removes the i'th buffered frame.
+func (conn *connV3) removeBuffered(i int) {
+	conn.dataBuffer = append(conn.dataBuffer[:i], conn.dataBuffer[i+1:]...)
+	if len(conn.dataBuffer) == 0 {
+		conn.dataBuffer = nil
+	}
+}
+
+// admitFrame returns the frame, or the part of a DATA
+// frame which the connection's transfer window allows
+// to be sent now, or nil. The rest is buffered until
+// the window grows, as are any frames on a stream which
+// already has data buffered, so that each stream's
+// frames stay in order.
+func (conn *connV3) admitFrame(frame Frame) Frame {
+	sid := orderedStreamID(frame)
+	if sid == 0 {
+		return frame
+	}
+	for _, buffered := range conn.dataBuffer {
+		if orderedStreamID(buffered) == sid {
+			conn.dataBuffer = append(conn.dataBuffer, frame)
+			return nil
+		}
+	}
+
+	data, ok := frame.(*dataFrameV3)
+	if !ok {
+		return frame
+	}
+	send, rest := conn.takeWindow(data)
+	if rest != nil {
+		conn.dataBuffer = append(conn.dataBuffer, rest)
+	}
+	if send == nil {
+		return nil
+	}
+	return send
+}
+
+// orderedStreamID returns the stream whose DATA
+// frames a frame must not overtake, or 0.
+func orderedStreamID(frame Frame) StreamID {
+	switch frame := frame.(type) {
+	case *dataFrameV3:
+		return frame.StreamID
+	case *headersFrameV3:
+		return frame.StreamID
+	case *rstStreamFrameV3:
+		return frame.StreamID
+	}
+	return 0
+}
+
+// takeWindow splits a DATA frame into the part which fits
+// in the connection's transfer window, which is deducted
+// from the window, and the rest, if any. The rest keeps
+// the frame's flags.
+func (conn *connV3) takeWindow(frame *dataFrameV3) (send, rest *dataFrameV3) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	size := int64(len(frame.Data))
+	if size <= conn.connectionWindowSize {
+		conn.connectionWindowSize -= size
+		return frame, nil
+	}
+	if conn.connectionWindowSize <= 0 {
+		return nil, frame
+	}
+
+	n := conn.connectionWindowSize
+	send = new(dataFrameV3)
+	send.StreamID = frame.StreamID
+	send.Data = frame.Data[:n]
+	rest = new(dataFrameV3)
+	rest.StreamID = frame.StreamID
+	rest.Flags = frame.Flags
+	rest.Data = frame.Data[n:]
+	conn.connectionWindowSize = 0
+	return send, rest
+}
+
+// reprioritise records a stream's new priority, and
+// returns the output channel its frames should now use.
+// Any data withheld by the stream's flow control will
+// be sent on the new channel.
+func (conn *connV3) reprioritise(sid StreamID, priority Priority, flow *flowControl) chan<- Frame {
+	conn.setStreamPriority(sid, priority)
+	output := conn.output[priority]
+	if flow != nil {
+		flow.Lock()
+		flow.output = output
+		flow.Unlock()
+	}
+	return output
+}
+
+// setStreamPriority records the priority of a stream.
+func (conn *connV3) setStreamPriority(sid StreamID, priority Priority) {
+	conn.priorityLock.Lock()
+	conn.priorities[sid] = priority
+	conn.priorityLock.Unlock()
+}
+
+// streamPriority returns the current priority of a stream.
+// This is used by the send loop, so does not take the
+// connection's lock.
+func (conn *connV3) streamPriority(sid StreamID) Priority {
+	conn.priorityLock.Lock()
+	defer conn.priorityLock.Unlock()
+	return conn.priorities[sid]
 }
 
 // Add timeouts if requested by the server.
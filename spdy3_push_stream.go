@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // pushStreamV3 is a structure that implements the
@@ -23,8 +25,16 @@ type pushStreamV3 struct {
 	origin   Stream
 	state    *StreamState
 	output   chan<- Frame
+	priority Priority
 	header   http.Header
 	stop     <-chan bool
+
+	writeDeadline deadline
+
+	// The response status, sent with the
+	// first HEADERS frame.
+	status      int
+	wroteHeader bool
 }
 
 /***********************
@@ -37,12 +47,17 @@ func (p *pushStreamV3) Header() http.Header {
 
 // Write is used for sending data in the push.
 func (p *pushStreamV3) Write(inputData []byte) (int, error) {
+	if err := p.writeDeadline.err(); err != nil {
+		return 0, err
+	}
+
 	if p.closed() || p.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, &StreamError{ID: p.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
 	}
 
-	state := p.origin.State()
-	if p.origin == nil || state.ClosedHere() {
+	// Once its SYN_STREAM has been sent, a push may
+	// continue after the origin stream has closed.
+	if p.origin == nil {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
@@ -71,9 +86,13 @@ func (p *pushStreamV3) Write(inputData []byte) (int, error) {
 	return written, err
 }
 
-// WriteHeader is provided to satisfy the Stream
-// interface, but has no effect.
-func (p *pushStreamV3) WriteHeader(int) {
+// WriteHeader sets the pushed response's status code,
+// if the response headers have not yet been sent, and
+// then sends any headers set so far.
+func (p *pushStreamV3) WriteHeader(code int) {
+	if !p.wroteHeader && code >= 100 && code <= 999 {
+		p.status = code
+	}
 	p.writeHeader()
 	return
 }
@@ -86,6 +105,7 @@ func (p *pushStreamV3) Close() error {
 	p.Lock()
 	defer p.Unlock()
 	p.writeHeader()
+	p.writeDeadline.stop()
 	if p.state != nil {
 		p.state.Close()
 	}
@@ -146,6 +166,56 @@ func (p *pushStreamV3) Run() error {
 	return nil
 }
 
+// Priority returns the stream's current priority.
+func (p *pushStreamV3) Priority() Priority {
+	p.Lock()
+	defer p.Unlock()
+	return p.priority
+}
+
+// SetPriority changes the priority of the frames the
+// stream sends from now on, including any data held back
+// by flow control. Frames already handed to the connection
+// keep their original priority.
+func (p *pushStreamV3) SetPriority(priority Priority) error {
+	if !priority.Valid(3) {
+		return errors.New("Error: Priority must be in the range 0 - 7.")
+	}
+
+	conn, ok := p.conn.(*connV3)
+	if !ok || p.closed() {
+		return &StreamError{ID: p.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.priority = priority
+	p.output = conn.reprioritise(p.streamID, priority, p.flow)
+	return nil
+}
+
+// SetReadDeadline is provided to satisfy the Stream
+// interface, but has no effect, as pushes receive no data.
+func (p *pushStreamV3) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets the time by which the push must
+// have been sent. If the push is unfinished when the
+// deadline passes, it is reset with RST_STREAM_CANCEL.
+// Writes after the deadline fail with os.ErrDeadlineExceeded.
+// A zero time removes the deadline.
+func (p *pushStreamV3) SetWriteDeadline(t time.Time) error {
+	if p.closed() {
+		return &StreamError{ID: p.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	p.writeDeadline.set(t, func() {
+		p.reset(RST_STREAM_CANCEL)
+	})
+	return nil
+}
+
 func (p *pushStreamV3) State() *StreamState {
 	return p.state
 }
@@ -159,6 +229,10 @@ func (p *pushStreamV3) StreamID() StreamID {
  **************/
 
 func (p *pushStreamV3) Finish() {
+	if p.closed() || p.state.ClosedHere() {
+		return
+	}
+
 	p.writeHeader()
 	end := new(dataFrameV3)
 	end.StreamID = p.streamID
@@ -172,6 +246,25 @@ func (p *pushStreamV3) Finish() {
  * Others *
  **********/
 
+// reset ends the push early by sending RST_STREAM
+// with the given status, and closing the stream.
+func (p *pushStreamV3) reset(status StatusCode) {
+	p.Lock()
+	if p.closed() || p.state.ClosedHere() {
+		p.Unlock()
+		return
+	}
+
+	rst := new(rstStreamFrameV3)
+	rst.StreamID = p.streamID
+	rst.Status = status
+	p.output <- rst
+	p.state.Close()
+	p.Unlock()
+
+	p.Close()
+}
+
 func (p *pushStreamV3) closed() bool {
 	if p.conn == nil || p.state == nil {
 		return true
@@ -185,15 +278,24 @@ func (p *pushStreamV3) closed() bool {
 }
 
 // writeHeader is used to send HTTP headers to
-// the client.
+// the client. The first HEADERS frame carries
+// the response's status and version.
 func (p *pushStreamV3) writeHeader() {
-	if len(p.header) == 0 || p.closed() {
+	if (p.wroteHeader && len(p.header) == 0) || p.closed() || p.state.ClosedHere() {
 		return
 	}
 
 	header := new(headersFrameV3)
 	header.StreamID = p.streamID
 	header.Header = make(http.Header)
+	if !p.wroteHeader {
+		if p.status == 0 {
+			p.status = http.StatusOK
+		}
+		p.wroteHeader = true
+		header.Header.Set(":status", strconv.Itoa(p.status))
+		header.Header.Set(":version", "HTTP/1.1")
+	}
 
 	for name, values := range p.header {
 		for _, value := range values {
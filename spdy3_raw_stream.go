@@ -0,0 +1,513 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rawStreamV3 is a structure that implements the
+// RawStream interface. This is used for streams
+// which carry raw bytes, opened by either endpoint.
+type rawStreamV3 struct {
+	sync.Mutex
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	conn       Conn
+	streamID   StreamID
+	flow       *flowControl
+	state      *StreamState
+	output     chan<- Frame
+	priority   Priority
+	header     http.Header // headers to be sent.
+	received   http.Header // headers received.
+	replied    bool        // whether the SYN_REPLY has been sent, or is not needed.
+	data       *bodyBuffer
+	stop       <-chan bool
+	finished   chan struct{}
+	err        error
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// newRawStream creates a raw stream with the given ID,
+// opened with the given headers. The connection must be
+// locked.
+func (conn *connV3) newRawStream(sid StreamID, priority Priority, header http.Header) *rawStreamV3 {
+	stream := new(rawStreamV3)
+	stream.conn = conn
+	stream.streamID = sid
+	stream.state = new(StreamState)
+	stream.output = conn.output[priority]
+	stream.priority = priority
+	stream.header = make(http.Header)
+	stream.received = make(http.Header)
+	for name, values := range header {
+		stream.received[name] = values
+	}
+	stream.data = newBodyBuffer()
+	stream.stop = conn.stop
+	stream.finished = make(chan struct{})
+	if conn.conn != nil {
+		stream.localAddr = conn.conn.LocalAddr()
+		stream.remoteAddr = conn.conn.RemoteAddr()
+	}
+	stream.AddFlowControl(conn.flowControl)
+	return stream
+}
+
+/***********************
+ * http.ResponseWriter *
+ ***********************/
+
+func (s *rawStreamV3) Header() http.Header {
+	return s.header
+}
+
+// Write sends data on the stream. Write waits for any
+// data held back by flow control to be sent first.
+func (s *rawStreamV3) Write(inputData []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.writeDeadline.err(); err != nil {
+		return 0, err
+	}
+
+	if s.closed() || s.state.ClosedHere() {
+		return 0, &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+
+	if err := s.waitForWindow(); err != nil {
+		return 0, err
+	}
+
+	// Copy the data locally to avoid any pointer issues.
+	data := make([]byte, len(inputData))
+	copy(data, inputData)
+
+	// Chunk the data if necessary.
+	// Data is sent to the flow control to
+	// ensure that the protocol is followed.
+	written := 0
+	for len(data) > MAX_DATA_SIZE {
+		n, err := s.flow.Write(data[:MAX_DATA_SIZE])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		data = data[MAX_DATA_SIZE:]
+	}
+
+	if len(data) > 0 {
+		n, err := s.flow.Write(data)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// WriteHeader sends any headers set so far.
+func (s *rawStreamV3) WriteHeader(int) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.writeHeader()
+}
+
+/*****************
+ * io.ReadCloser *
+ *****************/
+
+// Close cancels the stream with RST_STREAM,
+// unless both endpoints have sent FIN.
+func (s *rawStreamV3) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.readDeadline.stop()
+	s.writeDeadline.stop()
+	if s.state != nil {
+		if !s.state.Closed() && !s.connClosed() {
+			// Send the RST_STREAM.
+			rst := new(rstStreamFrameV3)
+			rst.StreamID = s.streamID
+			rst.Status = RST_STREAM_CANCEL
+			s.output <- rst
+		}
+		s.state.Close()
+	}
+	if s.flow != nil {
+		s.flow.Close()
+	}
+	s.data.finish(net.ErrClosed)
+	select {
+	case <-s.finished:
+	default:
+		close(s.finished)
+	}
+	return nil
+}
+
+// Read reads data sent by the other endpoint, returning
+// io.EOF once it has sent FIN.
+func (s *rawStreamV3) Read(out []byte) (int, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	n, err := s.data.readBefore(out, &s.readDeadline)
+
+	// Regrow the transfer window as
+	// the data is consumed.
+	if n > 0 && !s.closed() && s.state.OpenThere() {
+		s.flow.Receive(out[:n])
+	}
+	return n, err
+}
+
+/**********
+ * Stream *
+ **********/
+
+func (s *rawStreamV3) Conn() Conn {
+	return s.conn
+}
+
+func (s *rawStreamV3) ReceiveFrame(frame Frame) error {
+	if frame == nil {
+		return errors.New("Error: Nil frame received.")
+	}
+
+	// Process the frame depending on its type.
+	switch frame := frame.(type) {
+	case *dataFrameV3:
+		s.data.Write(frame.Data)
+		if frame.Flags.FIN() {
+			s.closeThere()
+		}
+
+	case *synReplyFrameV3:
+		s.receiveHeader(frame.Header)
+		if frame.Flags.FIN() {
+			s.closeThere()
+		}
+
+	case *headersFrameV3:
+		s.receiveHeader(frame.Header)
+		if frame.Flags.FIN() {
+			s.closeThere()
+		}
+
+	case *windowUpdateFrameV3:
+		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
+		if err != nil {
+			reply := new(rstStreamFrameV3)
+			reply.StreamID = s.streamID
+			reply.Status = RST_STREAM_FLOW_CONTROL_ERROR
+			s.output <- reply
+		}
+
+	default:
+		return errors.New(fmt.Sprintf("Received unknown frame of type %T.", frame))
+	}
+
+	return nil
+}
+
+func (s *rawStreamV3) CloseNotify() <-chan bool {
+	return s.stop
+}
+
+// Run blocks until the stream has finished in both
+// directions, or has been closed, and returns the
+// reason for any reset.
+func (s *rawStreamV3) Run() error {
+	<-s.finished
+
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// Priority returns the stream's current priority.
+func (s *rawStreamV3) Priority() Priority {
+	s.Lock()
+	defer s.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority of the frames the
+// stream sends from now on, including any data held back
+// by flow control. Frames already handed to the connection
+// keep their original priority.
+func (s *rawStreamV3) SetPriority(priority Priority) error {
+	if !priority.Valid(3) {
+		return errors.New("Error: Priority must be in the range 0 - 7.")
+	}
+
+	conn, ok := s.conn.(*connV3)
+	if !ok || s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.priority = priority
+	s.output = conn.reprioritise(s.streamID, priority, s.flow)
+	return nil
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (s *rawStreamV3) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the time after which Read fails
+// with os.ErrDeadlineExceeded, if no data has arrived.
+// Unlike other streams, the stream is not reset, so a
+// new deadline can be set and reading continued. A zero
+// time removes the deadline.
+func (s *rawStreamV3) SetReadDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.readDeadline.set(t, s.data.wake)
+	return nil
+}
+
+// SetWriteDeadline sets the time after which Write and
+// CloseWrite fail with os.ErrDeadlineExceeded, including
+// while waiting for the transfer window to grow. As with
+// SetReadDeadline, the stream is not reset. A zero time
+// removes the deadline.
+func (s *rawStreamV3) SetWriteDeadline(t time.Time) error {
+	if s.closed() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	s.writeDeadline.set(t, s.flow.wake)
+	return nil
+}
+
+func (s *rawStreamV3) State() *StreamState {
+	return s.state
+}
+
+func (s *rawStreamV3) StreamID() StreamID {
+	return s.streamID
+}
+
+/*************
+ * RawStream *
+ *************/
+
+// CloseWrite sends FIN, once any data held
+// back by flow control has been sent.
+func (s *rawStreamV3) CloseWrite() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.writeDeadline.err(); err != nil {
+		return err
+	}
+
+	if s.closed() || s.state.ClosedHere() {
+		return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+
+	if err := s.waitForWindow(); err != nil {
+		return err
+	}
+
+	data := new(dataFrameV3)
+	data.StreamID = s.streamID
+	data.Flags = FLAG_FIN
+	data.Data = []byte{}
+	s.output <- data
+
+	s.state.CloseHere()
+	if s.state.Closed() {
+		s.finish()
+	}
+	return nil
+}
+
+func (s *rawStreamV3) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *rawStreamV3) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *rawStreamV3) ReceivedHeader() http.Header {
+	s.Lock()
+	defer s.Unlock()
+	out := make(http.Header, len(s.received))
+	for name, values := range s.received {
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// resetByPeer closes the stream after the other endpoint
+// has reset it with RST_STREAM, recording the status so
+// that Read and Run can report it.
+func (s *rawStreamV3) resetByPeer(status StatusCode) {
+	err := &StreamError{ID: s.streamID, Status: status}
+	s.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.state.Close()
+	s.Unlock()
+	s.data.finish(err)
+	s.Close()
+}
+
+// receiveHeader records headers sent by the other endpoint.
+func (s *rawStreamV3) receiveHeader(header http.Header) {
+	s.Lock()
+	defer s.Unlock()
+	for name, values := range header {
+		s.received[name] = append(s.received[name], values...)
+	}
+}
+
+// closeThere marks the stream as finished
+// by the other endpoint.
+func (s *rawStreamV3) closeThere() {
+	s.data.finish(nil)
+	s.state.CloseThere()
+	if s.state.Closed() {
+		s.finish()
+	}
+}
+
+// finish marks the stream as having
+// finished in both directions.
+func (s *rawStreamV3) finish() {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.finished:
+	default:
+		close(s.finished)
+	}
+}
+
+// waitForWindow waits for any data held back by
+// flow control to be sent, as the transfer window
+// grows.
+func (s *rawStreamV3) waitForWindow() error {
+	for {
+		wait := s.flow.Wait()
+		if !s.flow.Paused() {
+			return nil
+		}
+		if err := s.writeDeadline.err(); err != nil {
+			return err
+		}
+		if s.closed() || s.state.ClosedHere() {
+			return &StreamError{ID: s.streamID, Status: RST_STREAM_STREAM_ALREADY_CLOSED}
+		}
+		select {
+		case <-wait:
+		case <-s.stop:
+		}
+	}
+}
+
+func (s *rawStreamV3) closed() bool {
+	if s.conn == nil || s.state == nil || s.state.Closed() {
+		return true
+	}
+	return s.connClosed()
+}
+
+// connClosed indicates whether the
+// connection has been closed.
+func (s *rawStreamV3) connClosed() bool {
+	select {
+	case _ = <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// reply acknowledges a stream opened by the other
+// endpoint with SYN_REPLY, carrying any headers set
+// so far.
+func (s *rawStreamV3) reply() {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.writeHeader()
+}
+
+// writeHeader is used to flush any headers. The
+// first headers sent on a stream opened by the other
+// endpoint are sent with SYN_REPLY, and any later
+// headers with HEADERS.
+func (s *rawStreamV3) writeHeader() {
+	if !s.replied {
+		s.replied = true
+		if s.closed() || s.state.ClosedHere() {
+			return
+		}
+
+		// Create the SYN_REPLY.
+		synReply := new(synReplyFrameV3)
+		synReply.StreamID = s.streamID
+		synReply.Header = make(http.Header)
+		for name, values := range s.header {
+			for _, value := range values {
+				synReply.Header.Add(name, value)
+			}
+			s.header.Del(name)
+		}
+
+		s.output <- synReply
+		return
+	}
+
+	if len(s.header) == 0 {
+		return
+	}
+
+	// Create the HEADERS frame.
+	header := new(headersFrameV3)
+	header.StreamID = s.streamID
+	header.Header = make(http.Header)
+
+	// Clear the headers that have been sent.
+	for name, values := range s.header {
+		for _, value := range values {
+			header.Header.Add(name, value)
+		}
+		s.header.Del(name)
+	}
+
+	s.output <- header
+}
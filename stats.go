@@ -0,0 +1,334 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stats contains statistics about the activity of one or
+// more SPDY connections.
+//
+// StreamsOpened counts the SYN_STREAMs sent and received.
+// StreamsRefused and StreamsReset count the RST_STREAMs sent
+// and received, with REFUSED_STREAM and any other status
+// respectively.
+//
+// The frame and byte counts are keyed by frame name, such as
+// "SYN_STREAM" or "DATA", and include the frame headers.
+//
+// WindowConstrained is the total time streams have spent
+// unable to send data because of their transfer windows.
+//
+// The compression ratios are the size of compressed header
+// blocks as a fraction of their uncompressed size.
+//
+// PingRTT is the round-trip time of the most recent PING
+// sent, and Pings is the number of PINGs answered.
+type Stats struct {
+	StreamsOpened                 uint64
+	StreamsRefused                uint64
+	StreamsReset                  uint64
+	FramesSent                    map[string]uint64
+	FramesReceived                map[string]uint64
+	BytesSent                     map[string]uint64
+	BytesReceived                 map[string]uint64
+	WindowConstrained             time.Duration
+	HeaderBytesSent               uint64
+	CompressedHeaderBytesSent     uint64
+	HeaderBytesReceived           uint64
+	CompressedHeaderBytesReceived uint64
+	CompressionRatioSent          float64
+	CompressionRatioReceived      float64
+	PingRTT                       time.Duration
+	Pings                         uint64
+}
+
+// connStats is used to collect the Stats for a
+// connection. Each update is also applied to the
+// parent, if any, which is used to aggregate the
+// Stats of a Server or Transport.
+type connStats struct {
+	sync.Mutex
+	stats  Stats
+	parent *connStats
+}
+
+func newConnStats(parent *connStats) *connStats {
+	out := new(connStats)
+	out.stats.FramesSent = make(map[string]uint64)
+	out.stats.FramesReceived = make(map[string]uint64)
+	out.stats.BytesSent = make(map[string]uint64)
+	out.stats.BytesReceived = make(map[string]uint64)
+	out.parent = parent
+	return out
+}
+
+// update applies f to the stats and those
+// of each parent.
+func (c *connStats) update(f func(*Stats)) {
+	for ; c != nil; c = c.parent {
+		c.Lock()
+		f(&c.stats)
+		c.Unlock()
+	}
+}
+
+// frameSent records a frame of n bytes being
+// sent to the other endpoint.
+func (c *connStats) frameSent(frame Frame, n int64) {
+	name := frame.Name()
+	c.update(func(s *Stats) {
+		s.FramesSent[name]++
+		s.BytesSent[name] += uint64(n)
+		countStreams(s, frame)
+	})
+}
+
+// frameReceived records a frame of n bytes being
+// received from the other endpoint.
+func (c *connStats) frameReceived(frame Frame, n int64) {
+	name := frame.Name()
+	c.update(func(s *Stats) {
+		s.FramesReceived[name]++
+		s.BytesReceived[name] += uint64(n)
+		countStreams(s, frame)
+	})
+}
+
+// headersSent records a header block being compressed
+// from uncompressed to compressed bytes.
+func (c *connStats) headersSent(uncompressed, compressed int) {
+	c.update(func(s *Stats) {
+		s.HeaderBytesSent += uint64(uncompressed)
+		s.CompressedHeaderBytesSent += uint64(compressed)
+	})
+}
+
+// headersReceived records a header block being decompressed
+// from compressed to uncompressed bytes.
+func (c *connStats) headersReceived(uncompressed, compressed int) {
+	c.update(func(s *Stats) {
+		s.HeaderBytesReceived += uint64(uncompressed)
+		s.CompressedHeaderBytesReceived += uint64(compressed)
+	})
+}
+
+// constrained records a stream having been unable
+// to send data for the given duration.
+func (c *connStats) constrained(d time.Duration) {
+	c.update(func(s *Stats) {
+		s.WindowConstrained += d
+	})
+}
+
+// ping records a PING response.
+func (c *connStats) ping(rtt time.Duration) {
+	c.update(func(s *Stats) {
+		s.PingRTT = rtt
+		s.Pings++
+	})
+}
+
+// snapshot returns a copy of the current stats.
+func (c *connStats) snapshot() *Stats {
+	if c == nil {
+		return newConnStats(nil).snapshot()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	out := new(Stats)
+	*out = c.stats
+	out.FramesSent = copyCounts(c.stats.FramesSent)
+	out.FramesReceived = copyCounts(c.stats.FramesReceived)
+	out.BytesSent = copyCounts(c.stats.BytesSent)
+	out.BytesReceived = copyCounts(c.stats.BytesReceived)
+	if out.HeaderBytesSent != 0 {
+		out.CompressionRatioSent = float64(out.CompressedHeaderBytesSent) / float64(out.HeaderBytesSent)
+	}
+	if out.HeaderBytesReceived != 0 {
+		out.CompressionRatioReceived = float64(out.CompressedHeaderBytesReceived) / float64(out.HeaderBytesReceived)
+	}
+	return out
+}
+
+// countStreams updates the stream counts if
+// the frame opens or resets a stream.
+func countStreams(s *Stats, frame Frame) {
+	var status StatusCode
+	switch frame := frame.(type) {
+	case *synStreamFrameV3, *synStreamFrameV3_1, *synStreamFrameV2:
+		s.StreamsOpened++
+		return
+	case *rstStreamFrameV3:
+		status = frame.Status
+	case *rstStreamFrameV2:
+		status = frame.Status
+	default:
+		return
+	}
+
+	if status == RST_STREAM_REFUSED_STREAM {
+		s.StreamsRefused++
+	} else {
+		s.StreamsReset++
+	}
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	out := make(map[string]uint64, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// headerSizes returns the compressed and uncompressed sizes
+// of the frame's name/value header block, if it has one. This
+// must be called while the frame has both its compressed and
+// decompressed headers.
+func headerSizes(frame Frame) (compressed, uncompressed int, ok bool) {
+	var raw []byte
+	var header http.Header
+	size := 4
+	switch frame := frame.(type) {
+	case *synStreamFrameV3:
+		raw, header = frame.rawHeader, frame.Header
+	case *synStreamFrameV3_1:
+		raw, header = frame.rawHeader, frame.Header
+	case *synReplyFrameV3:
+		raw, header = frame.rawHeader, frame.Header
+	case *headersFrameV3:
+		raw, header = frame.rawHeader, frame.Header
+	case *synStreamFrameV2:
+		raw, header, size = frame.rawHeader, frame.Header, 2
+	case *synReplyFrameV2:
+		raw, header, size = frame.rawHeader, frame.Header, 2
+	case *headersFrameV2:
+		raw, header, size = frame.rawHeader, frame.Header, 2
+	default:
+		return 0, 0, false
+	}
+
+	uncompressed = size
+	for name, values := range header {
+		uncompressed += size + len(name) + size
+		for i, value := range values {
+			if i > 0 {
+				uncompressed++ // null separator.
+			}
+			uncompressed += len(value)
+		}
+	}
+
+	return len(raw), uncompressed, true
+}
+
+// countingReader is an io.Reader which
+// counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newFrameReader returns a buffered reader for conn,
+// along with the counter used by bytesRead.
+func newFrameReader(conn net.Conn) (*bufio.Reader, *countingReader) {
+	counter := &countingReader{Reader: conn}
+	return bufio.NewReader(counter), counter
+}
+
+// bytesRead returns the number of bytes consumed
+// from buf, which reads from counter.
+func bytesRead(buf *bufio.Reader, counter *countingReader) int64 {
+	if counter == nil {
+		return 0
+	}
+	return counter.n - int64(buf.Buffered())
+}
+
+// Stats returns the statistics for this connection.
+func (conn *connV3) Stats() *Stats {
+	return conn.stats.snapshot()
+}
+
+// Stats returns the statistics for this connection.
+func (conn *connV2) Stats() *Stats {
+	return conn.stats.snapshot()
+}
+
+// statsForServer returns the aggregate stats
+// for srv, creating them if necessary.
+func statsForServer(srv *http.Server) *connStats {
+	return stateForServer(srv).stats
+}
+
+// ServerStats returns the statistics for all SPDY
+// connections served by srv.
+func ServerStats(srv *http.Server) *Stats {
+	return statsForServer(srv).snapshot()
+}
+
+// PublishServerStats publishes the statistics for all SPDY
+// connections served by srv through the expvar package,
+// under the given name. As with expvar.Publish, the name
+// must not already be in use.
+func PublishServerStats(name string, srv *http.Server) {
+	stats := statsForServer(srv)
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return stats.snapshot()
+	}))
+}
+
+// statsForTransport returns the aggregate stats
+// for t, creating them if necessary.
+func (t *Transport) statsForTransport() *connStats {
+	t.statsOnce.Do(func() {
+		t.stats = newConnStats(nil)
+	})
+	return t.stats
+}
+
+// Stats returns the statistics for all SPDY connections
+// made by the Transport.
+func (t *Transport) Stats() *Stats {
+	return t.statsForTransport().snapshot()
+}
+
+// PublishStats publishes the statistics for all SPDY
+// connections made by the Transport through the expvar
+// package, under the given name. As with expvar.Publish,
+// the name must not already be in use.
+func (t *Transport) PublishStats(name string) {
+	stats := t.statsForTransport()
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return stats.snapshot()
+	}))
+}
+
+// setStatsParent adds the given aggregate
+// stats to a connection.
+func setStatsParent(conn Conn, parent *connStats) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.stats.parent = parent
+	case *connV2:
+		conn.stats.parent = parent
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Trailers follow the net/http conventions. A handler may
+// declare trailers by naming them in the Trailer header
+// before calling WriteHeader, and then set their values once
+// the body has been written. Alternatively, any header whose
+// name begins with http.TrailerPrefix is sent as a trailer
+// with the prefix removed. Trailers are sent in a final
+// HEADERS frame, with the FIN flag set.
+
+// declaredTrailers returns the canonical names of
+// the trailers declared in header's Trailer values.
+func declaredTrailers(header http.Header) []string {
+	var names []string
+	for _, values := range header["Trailer"] {
+		for _, name := range strings.Split(values, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// isTrailer indicates whether the header name is one
+// of the declared trailers, or uses http.TrailerPrefix.
+func isTrailer(name string, declared []string) bool {
+	if strings.HasPrefix(name, http.TrailerPrefix) {
+		return true
+	}
+	for _, trailer := range declared {
+		if name == trailer {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTrailer indicates whether header contains any
+// trailers, declared in its Trailer values or using
+// http.TrailerPrefix.
+func hasTrailer(header http.Header) bool {
+	declared := declaredTrailers(header)
+	for name := range header {
+		if isTrailer(name, declared) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeTrailer removes the trailers from header,
+// returning them with any http.TrailerPrefix
+// removed from their names.
+func takeTrailer(header http.Header, declared []string) http.Header {
+	trailer := make(http.Header)
+	for name, values := range header {
+		if !isTrailer(name, declared) {
+			continue
+		}
+		key := http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))
+		trailer[key] = append(trailer[key], values...)
+		delete(header, name)
+	}
+	return trailer
+}
+
+// trailerReader is used as a response body, copying
+// the received trailers into the response's Trailer
+// once the body has been read to EOF.
+type trailerReader struct {
+	io.Reader
+	response *http.Response
+	trailer  http.Header
+}
+
+func (t *trailerReader) Read(b []byte) (int, error) {
+	n, err := t.Reader.Read(b)
+	if err == io.EOF && t.trailer != nil {
+		if t.response.Trailer == nil {
+			t.response.Trailer = make(http.Header, len(t.trailer))
+		}
+		for name, values := range t.trailer {
+			t.response.Trailer[name] = values
+		}
+		t.trailer = nil
+	}
+	return n, err
+}
+
+func (t *trailerReader) Close() error {
+	return nil
+}
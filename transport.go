@@ -64,9 +64,23 @@ type Transport struct {
 	// time does not include the time to read the response body.
 	ResponseHeaderTimeout time.Duration
 
+	// PingInterval, if non-zero, is the interval at which
+	// keepalive PINGs are sent on each SPDY connection. If
+	// MaxMissedPings consecutive PINGs go unanswered, the
+	// connection is closed. If MaxMissedPings is zero, 1 is
+	// used.
+	PingInterval   time.Duration
+	MaxMissedPings int
+
+	// IdleTimeout, if non-zero, is the time after which a SPDY
+	// connection with no active streams is closed.
+	IdleTimeout time.Duration
+
 	spdyConns map[string]Conn          // SPDY connections mapped to host:port.
 	tcpConns  map[string]chan net.Conn // Non-SPDY connections mapped to host:port.
 	connLimit map[string]chan struct{} // Used to enforce the TCP conn limit.
+	stats     *connStats               // Aggregate statistics for SPDY connections.
+	statsOnce sync.Once
 
 	// Priority is used to determine the request priority of SPDY
 	// requests. If nil, spdy.DefaultPriority is used.
@@ -78,10 +92,38 @@ type Transport struct {
 	Receiver Receiver
 
 	// PushReceiver is used to receive server pushes. If left nil,
-	// pushes will be refused. The provided Request will be that
-	// sent with the server push. See Receiver for more detail on
-	// its methods.
+	// pushes will be refused, unless PushCache is set. The provided
+	// Request will be that sent with the server push. See Receiver
+	// for more detail on its methods.
 	PushReceiver Receiver
+
+	// PushCache, if non-nil, stores server pushes, which are then
+	// used to serve later requests for the pushed resources. Pushes
+	// are also passed to PushReceiver, if it is set.
+	PushCache *PushCache
+
+	// MaxConcurrentPushes, if non-zero, is the maximum number of
+	// server pushes which may be in progress at once on each SPDY
+	// connection. It is sent to the server as the connection's
+	// SETTINGS_MAX_CONCURRENT_STREAMS.
+	MaxConcurrentPushes uint32
+
+	// DisablePush, if true, prevents the server from sending any
+	// pushes, by sending SETTINGS_MAX_CONCURRENT_STREAMS with a
+	// value of zero on each SPDY connection.
+	DisablePush bool
+
+	// PushContentTypes, if non-empty, lists the media types of
+	// server pushes to accept, such as "text/css" or "image/*".
+	// Pushes with other Content-Types are cancelled once their
+	// headers arrive.
+	PushContentTypes []string
+
+	// MaxPushSize, if non-zero, is the size of the largest push
+	// body accepted. Larger pushes are cancelled, either when a
+	// larger Content-Length is received, or once that much data
+	// has been received.
+	MaxPushSize int64
 }
 
 // dial makes the connection to an endpoint.
@@ -108,6 +150,88 @@ func (t *Transport) dial(u *url.URL) (net.Conn, error) {
 	}
 }
 
+// pushReceiver returns the Receiver for server
+// pushes on a new connection to u's host.
+func (t *Transport) pushReceiver(u *url.URL, version float64) Receiver {
+	receiver := t.PushReceiver
+	if t.PushCache != nil {
+		receiver = t.PushCache.receiver(u.Scheme+"://"+u.Host, version, receiver)
+	}
+	if receiver != nil && (len(t.PushContentTypes) > 0 || t.MaxPushSize > 0) {
+		receiver = newPushFilter(receiver, t.PushContentTypes, t.MaxPushSize)
+	}
+	return receiver
+}
+
+// addSPDYConn configures and starts a new SPDY connection,
+// adding it to the pool. The caller must hold t.m.
+func (t *Transport) addSPDYConn(host string, conn Conn) {
+	setStatsParent(conn, t.statsForTransport())
+	if t.PingInterval > 0 {
+		conn.SetKeepAlive(t.PingInterval, t.MaxMissedPings)
+	}
+	if t.IdleTimeout > 0 {
+		conn.SetIdleTimeout(t.IdleTimeout)
+	}
+	go conn.Run()
+	t.spdyConns[host] = conn
+
+	// Limit the server's pushes, if necessary.
+	if t.DisablePush || t.MaxConcurrentPushes > 0 {
+		limit := t.MaxConcurrentPushes
+		if t.DisablePush {
+			limit = 0
+		}
+		conn.SendSettings(Settings{
+			SETTINGS_MAX_CONCURRENT_STREAMS: &Setting{
+				ID:    SETTINGS_MAX_CONCURRENT_STREAMS,
+				Value: limit,
+			},
+		})
+	}
+
+	// Remove the connection from the pool once it closes.
+	go func() {
+		<-conn.CloseNotify()
+		t.m.Lock()
+		if t.spdyConns[host] == conn {
+			delete(t.spdyConns, host)
+		}
+		t.m.Unlock()
+	}()
+}
+
+// CloseIdleConnections closes any connections which were
+// previously connected from previous requests but are now
+// sitting idle. SPDY connections are idle if they have no
+// active streams, and are closed with a GOAWAY. It does not
+// interrupt any connections currently in use.
+func (t *Transport) CloseIdleConnections() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for host, conn := range t.spdyConns {
+		if c, ok := conn.(idler); ok && c.activeStreams() > 0 {
+			continue
+		}
+		delete(t.spdyConns, host)
+		go conn.Close()
+	}
+
+	for host, connChan := range t.tcpConns {
+	drain:
+		for {
+			select {
+			case tcpConn := <-connChan:
+				tcpConn.Close()
+				t.connLimit[host] <- struct{}{}
+			default:
+				break drain
+			}
+		}
+	}
+}
+
 // doHTTP is used to process an HTTP(S) request, using the TCP connection pool.
 func (t *Transport) doHTTP(conn net.Conn, req *http.Request) (*http.Response, error) {
 	debug.Printf("Requesting %q over HTTP.\n", req.URL.String())
@@ -151,6 +275,13 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
+	// Use a pushed response, if one is available.
+	if t.PushCache != nil {
+		if res, ok := t.PushCache.get(u.Scheme+"://"+u.Host, req); ok {
+			return res, nil
+		}
+	}
+
 	t.m.Lock()
 
 	// Initialise structures if necessary.
@@ -252,30 +383,27 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				return t.doHTTP(tcpConn, req)
 
 			case "spdy/3.1":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 3.1)
+				newConn, err := NewClientConn(tlsConn, t.pushReceiver(u, 3.1), 3.1)
 				if err != nil {
 					return nil, err
 				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
+				t.addSPDYConn(u.Host, newConn)
 				conn = newConn
 
 			case "spdy/3":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 3)
+				newConn, err := NewClientConn(tlsConn, t.pushReceiver(u, 3), 3)
 				if err != nil {
 					return nil, err
 				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
+				t.addSPDYConn(u.Host, newConn)
 				conn = newConn
 
 			case "spdy/2":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 2)
+				newConn, err := NewClientConn(tlsConn, t.pushReceiver(u, 2), 2)
 				if err != nil {
 					return nil, err
 				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
+				t.addSPDYConn(u.Host, newConn)
 				conn = newConn
 			}
 		} else {
@@ -309,15 +437,33 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 // handling of the response data. This is provided
 // by setting spdy.Transport.Receiver.
 type response struct {
+	sync.Mutex
 	StatusCode int
+	Status     string
 	Header     http.Header
 	Data       *bytes.Buffer
 	Request    *http.Request
 	Receiver   Receiver
+	TLS        *tls.ConnectionState
+
+	// Names of the headers carrying the status
+	// line, which differ between SPDY versions.
+	statusHeader  string
+	versionHeader string
+
+	// Trailers received after the
+	// response's data.
+	gotData bool
+	trailer http.Header
 }
 
 func (r *response) ReceiveData(req *http.Request, data []byte, finished bool) {
+	r.Lock()
 	r.Data.Write(data)
+	if len(data) > 0 {
+		r.gotData = true
+	}
+	r.Unlock()
 	if r.Receiver != nil {
 		r.Receiver.ReceiveData(req, data, finished)
 	}
@@ -326,18 +472,46 @@ func (r *response) ReceiveData(req *http.Request, data []byte, finished bool) {
 var statusRegex = regexp.MustCompile(`\A\s*(?P<code>\d+)`)
 
 func (r *response) ReceiveHeader(req *http.Request, header http.Header) {
+	r.Lock()
 	if r.Header == nil {
 		r.Header = make(http.Header)
 	}
-	updateHeader(r.Header, header)
-	if status := r.Header.Get(":status"); status != "" && statusRegex.MatchString(status) {
+
+	// Headers received after the data, or those
+	// announced as trailers once the response has
+	// started, are trailers.
+	received := header
+	if r.gotData || r.StatusCode != 0 {
+		declared := declaredTrailers(r.Header)
+		received = make(http.Header)
+		for name, values := range header {
+			if !r.gotData && !isTrailer(http.CanonicalHeaderKey(name), declared) {
+				received[name] = values
+				continue
+			}
+			if r.trailer == nil {
+				r.trailer = make(http.Header)
+			}
+			for _, value := range values {
+				r.trailer.Add(name, value)
+			}
+		}
+	}
+
+	updateHeader(r.Header, received)
+	if r.statusHeader == "" {
+		r.statusHeader = ":status"
+	}
+	if status := r.Header.Get(r.statusHeader); status != "" && statusRegex.MatchString(status) {
 		if matches := statusRegex.FindAllStringSubmatch(status, -1); matches != nil {
 			s, err := strconv.Atoi(matches[0][1])
 			if err == nil {
 				r.StatusCode = s
+				r.Status = strings.TrimSpace(status)
 			}
 		}
 	}
+	r.Unlock()
 	if r.Receiver != nil {
 		r.Receiver.ReceiveHeader(req, header)
 	}
@@ -350,22 +524,79 @@ func (r *response) ReceiveRequest(req *http.Request) bool {
 	return false
 }
 
+// Response produces the http.Response, as net/http would
+// have parsed the equivalent HTTP/1.1 response.
 func (r *response) Response() *http.Response {
 	if r.Data == nil {
 		r.Data = new(bytes.Buffer)
 	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	if r.versionHeader == "" {
+		r.versionHeader = ":version"
+	}
 	out := new(http.Response)
-	out.Status = fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode))
+
+	// Status line.
 	out.StatusCode = r.StatusCode
-	out.Proto = "HTTP/1.1"
-	out.ProtoMajor = 1
-	out.ProtoMinor = 1
+	out.Status = r.Status
+	if !strings.Contains(out.Status, " ") {
+		out.Status = fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode))
+	}
+	out.Proto = r.Header.Get(r.versionHeader)
+	major, minor, ok := http.ParseHTTPVersion(out.Proto)
+	if !ok {
+		out.Proto, major, minor = "HTTP/1.1", 1, 1
+	}
+	out.ProtoMajor = major
+	out.ProtoMinor = minor
+
+	// Headers, without those carrying the status line.
 	out.Header = r.Header
-	out.Body = &readCloser{r.Data}
-	out.ContentLength = int64(r.Data.Len())
+	out.Header.Del(r.statusHeader)
+	out.Header.Del(r.versionHeader)
+
+	// Announced trailers.
+	if announced := out.Header["Trailer"]; len(announced) > 0 {
+		out.Trailer = make(http.Header)
+		for _, names := range announced {
+			for _, name := range strings.Split(names, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					out.Trailer[http.CanonicalHeaderKey(name)] = nil
+				}
+			}
+		}
+		out.Header.Del("Trailer")
+	}
+
+	// Body.
+	out.ContentLength = -1
+	switch {
+	case r.StatusCode/100 == 1, r.StatusCode == http.StatusNoContent, r.StatusCode == http.StatusNotModified:
+		out.ContentLength = 0
+	case out.Header.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(strings.TrimSpace(out.Header.Get("Content-Length")), 10, 64)
+		if err == nil && n >= 0 {
+			out.ContentLength = n
+		}
+	}
+	head := r.Request != nil && r.Request.Method == "HEAD"
+	if r.Data.Len() == 0 && (out.ContentLength == 0 || head) {
+		out.Body = http.NoBody
+	} else {
+		out.Body = &readCloser{r.Data}
+	}
+
+	// Received trailers become available
+	// once the body has been read.
+	if len(r.trailer) > 0 {
+		out.Body = &trailerReader{Reader: out.Body, response: out, trailer: r.trailer}
+	}
+
 	out.TransferEncoding = nil
-	out.Close = true
-	out.Trailer = make(http.Header)
+	out.Close = false
 	out.Request = r.Request
+	out.TLS = r.TLS
 	return out
 }
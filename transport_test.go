@@ -0,0 +1,196 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		spdy2   bool
+		header  http.Header
+		data    string
+		status  string
+		code    int
+		proto   string
+		major   int
+		minor   int
+		length  int64
+		noBody  bool
+		removed []string
+	}{
+		{
+			name:   "status text",
+			header: http.Header{":status": {"200 Fine"}, ":version": {"HTTP/1.1"}},
+			data:   "hello",
+			status: "200 Fine", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+		},
+		{
+			name:   "status code only",
+			header: http.Header{":status": {"404"}, ":version": {"HTTP/1.1"}},
+			data:   "missing",
+			status: "404 Not Found", code: 404, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+		},
+		{
+			name:   "HTTP/1.0",
+			header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.0"}},
+			data:   "hello",
+			status: "200 OK", code: 200, proto: "HTTP/1.0", major: 1, minor: 0, length: -1,
+		},
+		{
+			name:   "invalid version",
+			header: http.Header{":status": {"200 OK"}, ":version": {"SPDY"}},
+			data:   "hello",
+			status: "200 OK", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+		},
+		{
+			name:   "SPDY/2 names",
+			spdy2:  true,
+			header: http.Header{"status": {"201 Created"}, "version": {"HTTP/1.1"}},
+			data:   "hello",
+			status: "201 Created", code: 201, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+			removed: []string{"status", "version"},
+		},
+		{
+			name:   "pseudo-headers removed",
+			header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}, "Content-Type": {"text/plain"}},
+			data:   "hello",
+			status: "200 OK", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+			removed: []string{":status", ":version"},
+		},
+		{
+			name:   "Content-Length",
+			header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}, "Content-Length": {"5"}},
+			data:   "hello",
+			status: "200 OK", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: 5,
+		},
+		{
+			name:   "invalid Content-Length",
+			header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}, "Content-Length": {"five"}},
+			data:   "hello",
+			status: "200 OK", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+		},
+		{
+			name:   "negative Content-Length",
+			header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}, "Content-Length": {"-5"}},
+			data:   "hello",
+			status: "200 OK", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: -1,
+		},
+		{
+			name:   "HEAD",
+			method: "HEAD",
+			header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}, "Content-Length": {"5"}},
+			status: "200 OK", code: 200, proto: "HTTP/1.1", major: 1, minor: 1, length: 5,
+			noBody: true,
+		},
+		{
+			name:   "204",
+			header: http.Header{":status": {"204 No Content"}, ":version": {"HTTP/1.1"}},
+			status: "204 No Content", code: 204, proto: "HTTP/1.1", major: 1, minor: 1, length: 0,
+			noBody: true,
+		},
+		{
+			name:   "304",
+			header: http.Header{":status": {"304 Not Modified"}, ":version": {"HTTP/1.1"}, "Content-Length": {"5"}},
+			status: "304 Not Modified", code: 304, proto: "HTTP/1.1", major: 1, minor: 1, length: 0,
+			noBody: true,
+		},
+	}
+
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &response{Data: new(bytes.Buffer), Request: req, statusHeader: ":status", versionHeader: ":version"}
+		if test.spdy2 {
+			res.statusHeader, res.versionHeader = "status", "version"
+		}
+		res.ReceiveHeader(req, test.header)
+		res.ReceiveData(req, []byte(test.data), true)
+
+		out := res.Response()
+		if out.Status != test.status {
+			t.Errorf("%s: Status is %q, expected %q.", test.name, out.Status, test.status)
+		}
+		if out.StatusCode != test.code {
+			t.Errorf("%s: StatusCode is %d, expected %d.", test.name, out.StatusCode, test.code)
+		}
+		if out.Proto != test.proto || out.ProtoMajor != test.major || out.ProtoMinor != test.minor {
+			t.Errorf("%s: Protocol is %q (%d.%d), expected %q (%d.%d).", test.name, out.Proto,
+				out.ProtoMajor, out.ProtoMinor, test.proto, test.major, test.minor)
+		}
+		if out.ContentLength != test.length {
+			t.Errorf("%s: ContentLength is %d, expected %d.", test.name, out.ContentLength, test.length)
+		}
+		for _, name := range test.removed {
+			if _, ok := out.Header[name]; ok {
+				t.Errorf("%s: Header %q was not removed.", test.name, name)
+			}
+		}
+		if test.noBody {
+			if out.Body != http.NoBody {
+				t.Errorf("%s: Body is %T, expected http.NoBody.", test.name, out.Body)
+			}
+			continue
+		}
+		body, err := io.ReadAll(out.Body)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if string(body) != test.data {
+			t.Errorf("%s: Body is %q, expected %q.", test.name, body, test.data)
+		}
+	}
+}
+
+// TestResponseTrailers checks that trailers received after the
+// data are only set in the response once the body has been read.
+func TestResponseTrailers(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &response{Data: new(bytes.Buffer), Request: req, statusHeader: ":status", versionHeader: ":version"}
+	res.ReceiveHeader(req, http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}, "Trailer": {"X-Checksum"}})
+	res.ReceiveData(req, []byte("hello"), false)
+	res.ReceiveHeader(req, http.Header{"X-Checksum": {"ok"}})
+
+	out := res.Response()
+	if _, ok := out.Header["Trailer"]; ok {
+		t.Error("Trailer header was not removed.")
+	}
+	if got := out.Header.Get("X-Checksum"); got != "" {
+		t.Errorf("Trailer was added to the header as %q.", got)
+	}
+	values, ok := out.Trailer["X-Checksum"]
+	if !ok {
+		t.Fatal("Announced trailer is missing.")
+	}
+	if values != nil {
+		t.Fatalf("Trailer is %q before the body was read.", values)
+	}
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("Body is %q, expected %q.", body, "hello")
+	}
+	if got := out.Trailer.Get("X-Checksum"); got != "ok" {
+		t.Fatalf("Trailer is %q after the body was read, expected %q.", got, "ok")
+	}
+}
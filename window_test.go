@@ -0,0 +1,185 @@
+// Copyright 2013 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestTrailersFollowBufferedData checks that, with SPDY/3.1, a
+// response's trailers are not sent while its DATA is held back
+// by the connection's transfer window.
+func TestTrailersFollowBufferedData(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 2*DEFAULT_INITIAL_WINDOW_SIZE)
+	start := make(chan struct{})
+	handled := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		<-start
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write(body)
+		w.Header().Set("X-Checksum", "ok")
+	})}
+	defer ReleaseServer(srv)
+
+	client, server := net.Pipe()
+	conn, err := NewServerConn(server, srv, 3.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		conn.Run()
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		conn.Close()
+		<-done
+	}()
+
+	// Send the request, and open the stream's window, so
+	// that only the connection's window is exhausted. The
+	// handler starts once the PING has been answered, by
+	// which time the stream's window has been updated.
+	com := NewCompressor(3)
+	defer com.Close()
+	syn := &synStreamFrameV3_1{Flags: FLAG_FIN, StreamID: 1, Header: http.Header{
+		":method":  {"GET"},
+		":path":    {"/"},
+		":version": {"HTTP/1.1"},
+		":host":    {"example.com"},
+		":scheme":  {"http"},
+	}}
+	if err := syn.Compress(com); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		syn.WriteTo(client)
+		(&windowUpdateFrameV3{StreamID: 1, DeltaWindowSize: 1 << 20, subversion: 1}).WriteTo(client)
+		(&pingFrameV3{PingID: 1}).WriteTo(client)
+	}()
+
+	// Read the response, growing the connection's window
+	// once it has been used up, and the stream has had
+	// time to send its trailers.
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := bufio.NewReader(client)
+	decom := NewDecompressor(3)
+	var received []byte
+	var trailer http.Header
+	grown := false
+	for finished := false; !finished; {
+		frame, err := readFrameV3(buf, 1)
+		if err == io.EOF {
+			t.Fatal("Connection closed before the response finished.")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+
+		switch frame := frame.(type) {
+		case *pingFrameV3:
+			close(start)
+			continue
+		case *dataFrameV3:
+			if trailer != nil {
+				t.Fatal("Received DATA after the trailers.")
+			}
+			received = append(received, frame.Data...)
+			finished = frame.Flags.FIN()
+		case *headersFrameV3:
+			trailer = frame.Header
+			finished = frame.Flags.FIN()
+		default:
+			continue
+		}
+
+		if !grown && len(received) >= DEFAULT_INITIAL_WINDOW_SIZE {
+			grown = true
+			go func() {
+				<-handled
+				time.Sleep(50 * time.Millisecond)
+				(&windowUpdateFrameV3{DeltaWindowSize: 1 << 20, subversion: 1}).WriteTo(client)
+			}()
+		}
+	}
+
+	if !bytes.Equal(received, body) {
+		t.Fatalf("Received %d bytes before the stream finished, expected %d.", len(received), len(body))
+	}
+	if got := trailer.Get("X-Checksum"); got != "ok" {
+		t.Fatalf("Received trailer %q, expected %q.", got, "ok")
+	}
+}
+
+// TestRawStreamInitialWindow checks that sending a new
+// INITIAL_WINDOW_SIZE resizes the window of an open raw
+// stream. If it did not, the receiver would wait for more
+// data than the sender may send before growing the window.
+func TestRawStreamInitialWindow(t *testing.T) {
+	a, b := net.Pipe()
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	defer ReleaseServer(srv)
+	receiver, err := NewServerConn(a, srv, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetRawStreams(true)
+	go receiver.Run()
+	defer receiver.Close()
+	sender, err := NewClientConn(b, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sender.Run()
+	defer sender.Close()
+
+	out, err := sender.OpenStream(http.Header{"Test": {"window"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := receiver.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrink the window, then wait for the sender
+	// to have received the new setting.
+	settings := Settings{SETTINGS_INITIAL_WINDOW_SIZE: &Setting{ID: SETTINGS_INITIAL_WINDOW_SIZE, Value: 1000}}
+	if err := receiver.SendSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := receiver.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("x"), 100000)
+	go func() {
+		out.Write(body)
+		out.CloseWrite()
+	}()
+
+	in.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != len(body) {
+		t.Fatalf("Received %d bytes, expected %d.", len(received), len(body))
+	}
+}